@@ -1,6 +1,9 @@
 package domain
 
-import "unsafe"
+import (
+	"errors"
+	"unsafe"
+)
 
 const ByteSize = 512
 const WordSize = 64
@@ -9,6 +12,11 @@ type Word uint64
 
 type Block [WordSize]Word
 
+// ErrMoved is returned by a store that needs the store under it to write blocks in place, when that
+// store moves one instead.
+var ErrMoved = errors.New("backing store moved a block on write")
+
+// A Store holds blocks. Stores shared between goroutines must be safe for concurrent use.
 type Store interface {
 	ReadBlock(id Word, b *Block) error
 	AddBlock(b *Block) (Word, error)
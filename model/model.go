@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/catlev/pkg/domain"
 	"github.com/catlev/pkg/path"
@@ -23,6 +24,7 @@ type Type struct {
 	Kind          TypeKind
 	Attributes    Attributes
 	Relationships Relationships
+	Indexes       Indexes
 }
 
 type TypeKind int
@@ -41,6 +43,14 @@ type Attribute struct {
 	Type        domain.Word
 }
 
+type Indexes []Index
+
+// An Index lets entities be found by attributes other than their identifying ones. Columns gives
+// the positions of the attributes in Attributes, in the order they are indexed.
+type Index struct {
+	Columns []int
+}
+
 type Relationships []Relationship
 
 type Relationship struct {
@@ -55,8 +65,9 @@ const (
 )
 
 var (
-	ErrUnknownElement = errors.New("unknown element")
-	ErrUnknownType    = errors.New("unknown type")
+	ErrUnknownElement   = errors.New("unknown element")
+	ErrUnknownType      = errors.New("unknown type")
+	ErrUnknownAttribute = errors.New("unknown attribute")
 )
 
 func Read(src io.Reader) (*EntityModel, error) {
@@ -76,6 +87,8 @@ func Read(src io.Reader) (*EntityModel, error) {
 
 func (ts *Types) read(r *stream.Reader) error {
 	var t Type
+	// indexes name attributes that may not have been read yet
+	var indexes [][]string
 	for r.Next() {
 		var err error
 		switch r.Name() {
@@ -85,6 +98,10 @@ func (ts *Types) read(r *stream.Reader) error {
 			err = t.Attributes.read(r.Record())
 		case "relationship":
 			err = t.Relationships.read(r.Record())
+		case "index":
+			var names []string
+			names, err = readIndex(r.Record())
+			indexes = append(indexes, names)
 		default:
 			err = fmt.Errorf("%s: %w", r.Name(), ErrUnknownElement)
 		}
@@ -92,6 +109,13 @@ func (ts *Types) read(r *stream.Reader) error {
 			return err
 		}
 	}
+	for _, names := range indexes {
+		idx, err := t.Attributes.resolveIndex(names)
+		if err != nil {
+			return err
+		}
+		t.Indexes = append(t.Indexes, idx)
+	}
 	*ts = append(*ts, t)
 	return nil
 }
@@ -118,6 +142,23 @@ func (as *Attributes) read(r *stream.Reader) error {
 	return nil
 }
 
+func (as Attributes) resolveIndex(names []string) (Index, error) {
+	var idx Index
+	for _, name := range names {
+		column := -1
+		for i, a := range as {
+			if a.Name == name {
+				column = i
+			}
+		}
+		if column < 0 {
+			return Index{}, fmt.Errorf("%s: %w", name, ErrUnknownAttribute)
+		}
+		idx.Columns = append(idx.Columns, column)
+	}
+	return idx, nil
+}
+
 func (as Attributes) parseAttributeType(name string) (domain.Word, error) {
 	switch name {
 	case "integer":
@@ -146,3 +187,20 @@ func (rs *Relationships) read(r *stream.Reader) error {
 	*rs = append(*rs, a)
 	return nil
 }
+
+// readIndex reads the names of the attributes in an index, which are separated by spaces.
+func readIndex(r *stream.Reader) ([]string, error) {
+	var names []string
+	for r.Next() {
+		switch r.Name() {
+		case "attributes":
+			names = strings.Fields(r.StringField())
+		default:
+			return nil, fmt.Errorf("%s: %w", r.Name(), ErrUnknownElement)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("index: %w", ErrUnknownAttribute)
+	}
+	return names, nil
+}
@@ -19,6 +19,8 @@ entity_type {
 	attribute { name: "y" type: "integer" }
 
 	relationship { name: "self" impl: "a" }
+
+	index { attributes: "y x" }
 }
 
 	`))
@@ -34,6 +36,20 @@ entity_type {
 			Relationships: Relationships{
 				{Name: "self", Impl: path.Expr{Kind: path.Rel, Value: "a"}},
 			},
+			Indexes: Indexes{
+				{Columns: []int{1, 0}},
+			},
 		}},
 	}, m)
 }
+
+func TestReadBadIndex(t *testing.T) {
+	_, err := Read(strings.NewReader(`
+entity_type {
+	name: "point"
+	attribute { name: "x" identifying: "true" type: "integer" }
+	index { attributes: "z" }
+}
+	`))
+	assert.ErrorIs(t, err, ErrUnknownAttribute)
+}
@@ -12,6 +12,15 @@ type Store interface {
 	ParseValue(valueID domain.Word, value string) (domain.Word, error)
 }
 
+// An IndexStore is a Store that can also find entities through the indexes that the model declares
+// for their types.
+type IndexStore interface {
+	Store
+	// FindIndexed gives the entities whose values for the columns of the given index start with
+	// the given values. The index is given by its position in the type's Indexes.
+	FindIndexed(entityID domain.Word, index int, values []domain.Word) Cursor
+}
+
 type Object struct {
 	EntityID domain.Word
 	Fields   []domain.Word
@@ -111,7 +120,14 @@ func (s Box) runQuery(a Query) Cursor {
 			pos: -1,
 		}
 	}
-	base := s.store.FindEntities(a.entityID, s.buildKey(a))
+	var base Cursor
+	key := s.buildKey(a)
+	index, values := s.chooseIndex(a)
+	if len(values) > len(key) {
+		base = s.store.(IndexStore).FindIndexed(a.entityID, index, values)
+	} else {
+		base = s.store.FindEntities(a.entityID, key)
+	}
 	return &whereCursor{
 		base: base,
 		arm:  a,
@@ -133,6 +149,29 @@ func (s Box) buildKey(a Query) []domain.Word {
 	return key
 }
 
+// chooseIndex picks the index that the query constrains the most leading columns of, if the store
+// has indexes, giving the values of those columns.
+func (s Box) chooseIndex(a Query) (int, []domain.Word) {
+	if _, ok := s.store.(IndexStore); !ok {
+		return 0, nil
+	}
+
+	best, bestValues := 0, []domain.Word(nil)
+	for i, idx := range s.model.Types[a.entityID].Indexes {
+		var values []domain.Word
+		for _, c := range idx.Columns {
+			if !a.constrains(c) {
+				break
+			}
+			values = append(values, a.where[c])
+		}
+		if len(values) > len(bestValues) {
+			best, bestValues = i, values
+		}
+	}
+	return best, bestValues
+}
+
 func (s *Box) simplify() {
 	sort.Slice(s.contents, func(i, j int) bool {
 		a := s.contents[i]
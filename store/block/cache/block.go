@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// Store keeps the most recently used blocks of another store in memory, up to a fixed number of
+// them. Writes are held in memory until the block is evicted or the store is flushed, so the
+// backing store must keep a block where it is when it is written. Blocks are added to and freed
+// from the backing store straight away. It is safe for concurrent use.
+type Store struct {
+	mu      sync.Mutex
+	backing domain.Store
+	size    int
+	pages   map[domain.Word]*list.Element
+	lru     *list.List
+	stats   Stats
+}
+
+// Stats counts what the cache has done since it was created.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Dirty is the number of blocks written to the cache but not yet to the backing store.
+	Dirty int
+}
+
+type page struct {
+	id    domain.Word
+	block domain.Block
+	dirty bool
+}
+
+// New gives a cache of up to size blocks in front of backing.
+func New(backing domain.Store, size int) *Store {
+	return &Store{
+		backing: backing,
+		size:    max(size, 1),
+		pages:   map[domain.Word]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.pages[id]; ok {
+		s.stats.Hits++
+		s.lru.MoveToFront(e)
+		*b = e.Value.(*page).block
+		return nil
+	}
+
+	s.stats.Misses++
+	err := s.makeRoom()
+	if err != nil {
+		return err
+	}
+	err = s.backing.ReadBlock(id, b)
+	if err != nil {
+		return err
+	}
+	s.insert(&page{id: id, block: *b})
+	return nil
+}
+
+func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.makeRoom()
+	if err != nil {
+		return 0, err
+	}
+	id, err := s.backing.AddBlock(b)
+	if err != nil {
+		return 0, err
+	}
+	s.insert(&page{id: id, block: *b})
+	return id, nil
+}
+
+func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.pages[id]; ok {
+		p := e.Value.(*page)
+		p.block = *b
+		s.markDirty(p)
+		s.lru.MoveToFront(e)
+		return id, nil
+	}
+
+	err := s.makeRoom()
+	if err != nil {
+		return 0, err
+	}
+	p := &page{id: id, block: *b}
+	s.markDirty(p)
+	s.insert(p)
+	return id, nil
+}
+
+func (s *Store) FreeBlock(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.pages[id]; ok {
+		// whatever was written to the block no longer matters
+		s.remove(e)
+	}
+	return s.backing.FreeBlock(id)
+}
+
+// Flush writes every dirty block to the backing store. The blocks stay in the cache.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for e := s.lru.Back(); e != nil; e = e.Prev() {
+		err := s.writeBack(e.Value.(*page))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats gives the counts of what the cache has done.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// makeRoom evicts the least recently used pages until there is room for one more, writing back
+// those that are dirty. It is called before a block is taken into the cache, so that should a
+// write-back fail, the block has been neither read, added nor written.
+func (s *Store) makeRoom() error {
+	for s.lru.Len() >= s.size {
+		e := s.lru.Back()
+		err := s.writeBack(e.Value.(*page))
+		if err != nil {
+			return err
+		}
+		s.remove(e)
+		s.stats.Evictions++
+	}
+	return nil
+}
+
+// insert adds a page to the front of the cache, which makeRoom has made room for.
+func (s *Store) insert(p *page) {
+	s.pages[p.id] = s.lru.PushFront(p)
+}
+
+func (s *Store) remove(e *list.Element) {
+	p := e.Value.(*page)
+	if p.dirty {
+		s.stats.Dirty--
+	}
+	s.lru.Remove(e)
+	delete(s.pages, p.id)
+}
+
+func (s *Store) markDirty(p *page) {
+	if !p.dirty {
+		p.dirty = true
+		s.stats.Dirty++
+	}
+}
+
+func (s *Store) writeBack(p *page) error {
+	if !p.dirty {
+		return nil
+	}
+	id, err := s.backing.WriteBlock(p.id, &p.block)
+	if err != nil {
+		return err
+	}
+	if id != p.id {
+		return domain.ErrMoved
+	}
+	p.dirty = false
+	s.stats.Dirty--
+	return nil
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/file"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStore struct {
+	*mem.Store
+	reads, writes int
+}
+
+func (s *countingStore) ReadBlock(id domain.Word, b *domain.Block) error {
+	s.reads++
+	return s.Store.ReadBlock(id, b)
+}
+
+func (s *countingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	s.writes++
+	return s.Store.WriteBlock(id, b)
+}
+
+func TestReadHits(t *testing.T) {
+	backing := &countingStore{Store: mem.New()}
+	var ids []domain.Word
+	for i := 0; i < 4; i++ {
+		id, err := backing.AddBlock(&domain.Block{domain.Word(i)})
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	s := New(backing, 2)
+	var b domain.Block
+	for _, i := range []int{0, 1, 0, 1, 2, 0, 1} {
+		require.Nil(t, s.ReadBlock(ids[i], &b))
+		assert.Equal(t, domain.Word(i), b[0])
+	}
+
+	// 2 evicts 0, which then evicts 1
+	assert.Equal(t, Stats{Hits: 2, Misses: 5, Evictions: 3}, s.Stats())
+	assert.Equal(t, 5, backing.reads)
+}
+
+func TestWriteBack(t *testing.T) {
+	backing := &countingStore{Store: mem.New()}
+	s := New(backing, 2)
+
+	a, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	b, err := s.AddBlock(&domain.Block{2})
+	require.Nil(t, err)
+
+	for i := domain.Word(0); i < 10; i++ {
+		_, err = s.WriteBlock(a, &domain.Block{i})
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 0, backing.writes)
+	assert.Equal(t, 1, s.Stats().Dirty)
+
+	var blk domain.Block
+	require.Nil(t, s.ReadBlock(a, &blk))
+	assert.Equal(t, domain.Word(9), blk[0])
+	require.Nil(t, backing.Store.ReadBlock(a, &blk))
+	assert.Equal(t, domain.Word(1), blk[0])
+
+	// evicting a writes it back
+	require.Nil(t, s.ReadBlock(b, &blk))
+	_, err = s.AddBlock(&domain.Block{3})
+	require.Nil(t, err)
+	assert.Equal(t, 1, backing.writes)
+	require.Nil(t, backing.Store.ReadBlock(a, &blk))
+	assert.Equal(t, domain.Word(9), blk[0])
+
+	_, err = s.WriteBlock(b, &domain.Block{4})
+	require.Nil(t, err)
+	require.Nil(t, s.Flush())
+	assert.Equal(t, 0, s.Stats().Dirty)
+	require.Nil(t, backing.Store.ReadBlock(b, &blk))
+	assert.Equal(t, domain.Word(4), blk[0])
+
+	// a freed block is not written back
+	_, err = s.WriteBlock(b, &domain.Block{5})
+	require.Nil(t, err)
+	require.Nil(t, s.FreeBlock(b))
+	require.Nil(t, s.Flush())
+	assert.Equal(t, 2, backing.writes)
+	assert.Equal(t, 0, s.Stats().Dirty)
+}
+
+func TestTreeOverFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "db"))
+	require.Nil(t, err)
+	defer f.Close()
+	backing, err := file.New(f)
+	require.Nil(t, err)
+
+	s := New(backing, 16)
+	root, err := s.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	tr := tree.New(2, 1, s, 0, root)
+	for k := domain.Word(1); k <= 2000; k++ {
+		require.Nil(t, tr.Put([]domain.Word{k, k * 3}))
+	}
+	for k := domain.Word(1); k <= 2000; k += 2 {
+		require.Nil(t, tr.Delete([]domain.Word{k}))
+	}
+	require.Nil(t, s.Flush())
+
+	// the file alone now holds the tree
+	reopened := tree.New(2, 1, backing, tr.Depth(), tr.Root())
+	for k := domain.Word(1); k <= 2000; k++ {
+		row, err := reopened.Get([]domain.Word{k})
+		if k%2 == 1 {
+			assert.ErrorIs(t, err, tree.ErrNotFound)
+			continue
+		}
+		require.Nil(t, err)
+		assert.Equal(t, []domain.Word{k, k * 3}, row)
+	}
+	assert.Greater(t, s.Stats().Hits, s.Stats().Misses)
+}
+
+// failingStore fails every write while fail is set, and counts the blocks in use.
+type failingStore struct {
+	*mem.Store
+	fail bool
+	live int
+}
+
+func (s *failingStore) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.live++
+	return s.Store.AddBlock(b)
+}
+
+func (s *failingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	if s.fail {
+		return 0, errors.New("simulated failure")
+	}
+	return s.Store.WriteBlock(id, b)
+}
+
+func TestEvictionFailure(t *testing.T) {
+	backing := &failingStore{Store: mem.New()}
+	other, err := backing.AddBlock(&domain.Block{7})
+	require.Nil(t, err)
+	s := New(backing, 1)
+
+	a, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	_, err = s.WriteBlock(a, &domain.Block{2})
+	require.Nil(t, err)
+
+	// a cannot be written back to make room, so nothing else is taken in
+	backing.fail = true
+	live := backing.live
+	_, err = s.AddBlock(&domain.Block{3})
+	assert.NotNil(t, err)
+	assert.Equal(t, live, backing.live)
+	var b domain.Block
+	assert.NotNil(t, s.ReadBlock(other, &b))
+	_, err = s.WriteBlock(other, &domain.Block{8})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, s.lru.Len())
+	assert.Equal(t, 1, s.Stats().Dirty)
+
+	backing.fail = false
+	require.Nil(t, s.ReadBlock(other, &b))
+	assert.Equal(t, domain.Block{7}, b)
+	require.Nil(t, backing.Store.ReadBlock(a, &b))
+	assert.Equal(t, domain.Block{2}, b)
+}
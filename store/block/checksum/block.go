@@ -0,0 +1,177 @@
+package checksum
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc64"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/tree"
+)
+
+var (
+	ErrCorrupt  = errors.New("block does not match its checksum")
+	ErrUnlisted = errors.New("backing store cannot list its blocks")
+)
+
+// A CorruptionError reports a block that has changed since it was written through the store.
+type CorruptionError struct {
+	ID        domain.Word
+	Want, Got uint64
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("block %d: %s", e.ID, ErrCorrupt)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupt
+}
+
+var table = crc64.MakeTable(crc64.ECMA)
+
+// Store checks the blocks of another store against a CRC-64 of each, taken when the block was
+// last written through the store. The checksums are kept in a tree of three columns keyed by the
+// first, which maps each block id to its checksum and a 1, telling a checksum of zero apart from a
+// block that has none. The tree writes its blocks to a store without checksums, such as the
+// backing store, as a store cannot check the blocks that its checksums are kept in.
+//
+// Blocks that have never been written through the store have no checksum, and so are not checked.
+type Store struct {
+	backing domain.Store
+	sums    *tree.Tree
+}
+
+// A Lister is a store that can list the blocks it has allocated, as stores from mem.New and
+// file.New can.
+type Lister interface {
+	Allocated() ([]domain.Word, error)
+}
+
+// A Report gives what Scrub found.
+type Report struct {
+	// Corrupt holds the blocks that do not match their checksums.
+	Corrupt []*CorruptionError
+	// Unchecked holds the blocks that have no checksum, among them those of the tree of checksums.
+	Unchecked []domain.Word
+	// Problems holds what tree.Verify finds wrong with the tree of checksums.
+	Problems []tree.Problem
+}
+
+// New gives a store that checks the blocks of backing against the checksums in sums.
+func New(backing domain.Store, sums *tree.Tree) *Store {
+	return &Store{backing: backing, sums: sums}
+}
+
+// ReadBlock reads a block, returning a *CorruptionError if it does not match its checksum.
+func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
+	err := s.backing.ReadBlock(id, b)
+	if err != nil {
+		return err
+	}
+	err = s.check(id, b)
+	if errors.Is(err, tree.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	id, err := s.backing.AddBlock(b)
+	if err != nil {
+		return 0, err
+	}
+	return id, s.record(id, b)
+}
+
+func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	newID, err := s.backing.WriteBlock(id, b)
+	if err != nil {
+		return 0, err
+	}
+	if newID != id {
+		err = s.forget(id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return newID, s.record(newID, b)
+}
+
+func (s *Store) FreeBlock(id domain.Word) error {
+	err := s.backing.FreeBlock(id)
+	if err != nil {
+		return err
+	}
+	return s.forget(id)
+}
+
+// Scrub reads every block that the backing store has allocated, and checks each that has a
+// checksum against it. The tree of checksums is checked with tree.Verify. If the backing store is
+// not a Lister, ErrUnlisted is returned. Errors may originate from either store.
+func (s *Store) Scrub() (*Report, error) {
+	l, ok := s.backing.(Lister)
+	if !ok {
+		return nil, ErrUnlisted
+	}
+	ids, err := l.Allocated()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	for _, id := range ids {
+		var b domain.Block
+		err = s.backing.ReadBlock(id, &b)
+		if err != nil {
+			return nil, err
+		}
+
+		var corrupt *CorruptionError
+		err = s.check(id, &b)
+		switch {
+		case errors.Is(err, tree.ErrNotFound):
+			report.Unchecked = append(report.Unchecked, id)
+		case errors.As(err, &corrupt):
+			report.Corrupt = append(report.Corrupt, corrupt)
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	report.Problems, err = tree.Verify(s.sums)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// check compares b with the checksum of the block, returning tree.ErrNotFound if it has none.
+func (s *Store) check(id domain.Word, b *domain.Block) error {
+	row, err := s.sums.Get([]domain.Word{id})
+	if err != nil {
+		return err
+	}
+	if row[2] == 0 {
+		// the row for the zero id, which the tree holds from the start
+		return tree.ErrNotFound
+	}
+
+	got := crc64.Checksum(b.Bytes(), table)
+	if uint64(row[1]) == got {
+		return nil
+	}
+	return &CorruptionError{ID: id, Want: uint64(row[1]), Got: got}
+}
+
+func (s *Store) record(id domain.Word, b *domain.Block) error {
+	return s.sums.Put([]domain.Word{id, domain.Word(crc64.Checksum(b.Bytes(), table)), 1})
+}
+
+func (s *Store) forget(id domain.Word) error {
+	err := s.sums.Delete([]domain.Word{id})
+	if errors.Is(err, tree.ErrNotFound) {
+		return nil
+	}
+	return err
+}
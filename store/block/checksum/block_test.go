@@ -0,0 +1,116 @@
+package checksum
+
+import (
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorruption(t *testing.T) {
+	backing := mem.New()
+	root, err := backing.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	s := New(backing, tree.New(3, 1, backing, 0, root))
+
+	id, err := s.AddBlock(&domain.Block{1, 2, 3})
+	require.Nil(t, err)
+	var b domain.Block
+	require.Nil(t, s.ReadBlock(id, &b))
+	assert.Equal(t, domain.Block{1, 2, 3}, b)
+
+	// a bit flips behind the store's back
+	_, err = backing.WriteBlock(id, &domain.Block{1, 2, 7})
+	require.Nil(t, err)
+
+	err = s.ReadBlock(id, &b)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	var corrupt *CorruptionError
+	require.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, id, corrupt.ID)
+
+	// writing the block through the store again makes it good
+	_, err = s.WriteBlock(id, &domain.Block{4})
+	require.Nil(t, err)
+	require.Nil(t, s.ReadBlock(id, &b))
+	assert.Equal(t, domain.Block{4}, b)
+}
+
+func TestUnchecked(t *testing.T) {
+	// the checksums may be kept in a store of their own
+	backing, sums := mem.New(), mem.New()
+	s := New(backing, tree.New(3, 1, sums, 0, 0))
+
+	id, err := backing.AddBlock(&domain.Block{9})
+	require.Nil(t, err)
+	var b domain.Block
+	require.Nil(t, s.ReadBlock(id, &b))
+	require.Nil(t, s.ReadBlock(0, &b))
+
+	// a freed block is no longer checked
+	id, err = s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	require.Nil(t, s.FreeBlock(id))
+	_, err = backing.WriteBlock(id, &domain.Block{2})
+	require.Nil(t, err)
+	require.Nil(t, s.ReadBlock(id, &b))
+
+	// but a checksum of zero is checked like any other
+	require.Nil(t, s.sums.Put([]domain.Word{id, 0, 1}))
+	var corrupt *CorruptionError
+	require.ErrorAs(t, s.ReadBlock(id, &b), &corrupt)
+	assert.Zero(t, corrupt.Want)
+}
+
+func TestScrub(t *testing.T) {
+	backing := mem.New()
+	sumsRoot, err := backing.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	sums := tree.New(3, 1, backing, 0, sumsRoot)
+	s := New(backing, sums)
+
+	root, err := s.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	tr := tree.New(2, 1, s, 0, root)
+	for k := domain.Word(1); k <= 1000; k++ {
+		require.Nil(t, tr.Put([]domain.Word{k, k * 3}))
+	}
+	for k := domain.Word(1); k <= 1000; k += 3 {
+		require.Nil(t, tr.Delete([]domain.Word{k}))
+	}
+
+	report, err := s.Scrub()
+	require.Nil(t, err)
+	assert.Empty(t, report.Corrupt)
+	assert.Empty(t, report.Problems)
+	// block 0 and the blocks of the tree of checksums are the only ones without checksums
+	assert.Contains(t, report.Unchecked, domain.Word(0))
+	assert.Contains(t, report.Unchecked, sums.Root())
+	assert.NotContains(t, report.Unchecked, tr.Root())
+	unchecked := len(report.Unchecked)
+
+	var b domain.Block
+	require.Nil(t, backing.ReadBlock(tr.Root(), &b))
+	b[len(b)-1] ^= 1 << 40
+	_, err = backing.WriteBlock(tr.Root(), &b)
+	require.Nil(t, err)
+	stray, err := backing.AddBlock(&domain.Block{5})
+	require.Nil(t, err)
+
+	report, err = s.Scrub()
+	require.Nil(t, err)
+	require.Len(t, report.Corrupt, 1)
+	assert.Equal(t, tr.Root(), report.Corrupt[0].ID)
+	assert.Len(t, report.Unchecked, unchecked+1)
+	assert.Contains(t, report.Unchecked, stray)
+
+	_, err = tr.Get([]domain.Word{2})
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// without a way to list the blocks of the backing store, there is nothing to scrub
+	_, err = New(struct{ domain.Store }{backing}, sums).Scrub()
+	assert.ErrorIs(t, err, ErrUnlisted)
+}
@@ -0,0 +1,340 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/tree"
+)
+
+var ErrCorrupt = errors.New("slot does not hold a packed block")
+
+// Blocks are packed as the number of words up to the last that is not zero, followed by those
+// words, each as a varint. A packed block goes in the smallest slot that holds it, slots being
+// carved out of backing blocks of slots all of one size. A block that packs to more than half a
+// backing block is kept unpacked in a backing block of its own, and a block of zeros takes no slot.
+const (
+	minSlot = 32
+	maxSlot = domain.ByteSize
+)
+
+// The table has a row for each block in the store: its id, the backing block of its slot, and the
+// offset of the slot in the backing block and its size, as offset<<16 | size.
+const (
+	tableBlock = 1
+	tablePlace = 2
+)
+
+type slot struct {
+	block  domain.Word
+	offset int
+}
+
+// Store packs the blocks given to it into variable-size slots in another store, which must write
+// blocks in place. Blocks are found through a table of three columns keyed by the first. The table
+// is read to find any block, so it cannot itself be kept in the store.
+//
+// Block 0 is reserved, as in a store from mem.New, and the rest are numbered from 1 up. It is safe
+// for concurrent use.
+type Store struct {
+	backing domain.Store
+	table   *tree.Tree
+
+	mu   sync.Mutex
+	next domain.Word
+	// free holds the free slots of each size, and used the number of slots in use in each
+	// backing block that is carved into slots
+	free map[int][]slot
+	used map[domain.Word]int
+}
+
+// New gives a store that keeps blocks in backing, as table lays them out. The table is read in full
+// to find the free slots.
+func New(backing domain.Store, table *tree.Tree) (*Store, error) {
+	s := &Store{
+		backing: backing,
+		table:   table,
+		next:    1,
+		free:    map[int][]slot{},
+		used:    map[domain.Word]int{},
+	}
+
+	taken := map[domain.Word]map[int]bool{}
+	sizes := map[domain.Word]int{}
+	r := table.GetRange(tree.Bound{}, tree.Bound{})
+	for r.Next() {
+		row := r.This()
+		s.next = max(s.next, row[0]+1)
+		sl, size := place(row)
+		if size == 0 || size == maxSlot {
+			continue
+		}
+		if taken[sl.block] == nil {
+			taken[sl.block] = map[int]bool{}
+		}
+		taken[sl.block][sl.offset] = true
+		sizes[sl.block] = size
+		s.used[sl.block]++
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	for block, offsets := range taken {
+		size := sizes[block]
+		for offset := 0; offset < maxSlot; offset += size {
+			if !offsets[offset] {
+				s.free[size] = append(s.free[size], slot{block, offset})
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+	sl, size := place(row)
+	if size == 0 {
+		*b = domain.Block{}
+		return nil
+	}
+
+	var bb domain.Block
+	err = s.backing.ReadBlock(sl.block, &bb)
+	if err != nil {
+		return err
+	}
+	if size == maxSlot {
+		*b = bb
+		return nil
+	}
+	return unpack(b, bb.Bytes()[sl.offset:sl.offset+size])
+}
+
+func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.next
+	err := s.store(id, nil, b)
+	if err != nil {
+		return 0, err
+	}
+	s.next++
+	return id, nil
+}
+
+func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, err := s.lookup(id)
+	if err != nil {
+		return 0, err
+	}
+	return id, s.store(id, row, b)
+}
+
+func (s *Store) FreeBlock(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+	err = s.release(place(row))
+	if err != nil {
+		return err
+	}
+	return s.table.Delete([]domain.Word{id})
+}
+
+// lookup gives the table row for a block. Block 0 is always there, as the zero row of the table.
+func (s *Store) lookup(id domain.Word) ([]domain.Word, error) {
+	row, err := s.table.Get([]domain.Word{id})
+	if errors.Is(err, tree.ErrNotFound) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return row, err
+}
+
+// store writes b as the block with the given id, whose table row is old if it has one. The slot the
+// block is in is written over if it is the right size. Otherwise the block is written to a slot
+// that is, and the old slot is only given back once the table has the new one, so that the block
+// is never without a slot that holds it.
+func (s *Store) store(id domain.Word, old []domain.Word, b *domain.Block) error {
+	var buf [maxSlot]byte
+	packed := pack(buf[:0], b)
+
+	size := 0
+	if len(packed) > maxSlot/2 {
+		size = maxSlot
+	} else if len(packed) > 0 {
+		size = minSlot
+		for size < len(packed) {
+			size *= 2
+		}
+	}
+
+	var oldSlot slot
+	oldSize := 0
+	if old != nil {
+		oldSlot, oldSize = place(old)
+		if size == oldSize {
+			return s.fill(oldSlot, size, buf[:size], b)
+		}
+	}
+
+	sl, err := s.claim(size)
+	if err != nil {
+		return err
+	}
+	err = s.fill(sl, size, buf[:size], b)
+	if err == nil {
+		err = s.table.Put([]domain.Word{id, sl.block, domain.Word(sl.offset<<16 | size)})
+	}
+	if err != nil {
+		return errors.Join(err, s.release(sl, size))
+	}
+
+	if old == nil {
+		return nil
+	}
+	return s.release(oldSlot, oldSize)
+}
+
+// fill writes b to a slot of the given size, packed as buf unless the slot is a whole block.
+func (s *Store) fill(sl slot, size int, buf []byte, b *domain.Block) error {
+	switch size {
+	case 0:
+		return nil
+	case maxSlot:
+		return s.write(sl.block, b)
+	}
+
+	var bb domain.Block
+	err := s.backing.ReadBlock(sl.block, &bb)
+	if err != nil {
+		return err
+	}
+	copy(bb.Bytes()[sl.offset:sl.offset+size], buf)
+	return s.write(sl.block, &bb)
+}
+
+// claim takes a free slot of the given size, carving up a new backing block if there is none.
+func (s *Store) claim(size int) (slot, error) {
+	if size == 0 {
+		return slot{}, nil
+	}
+
+	free := s.free[size]
+	if len(free) != 0 {
+		sl := free[len(free)-1]
+		s.free[size] = free[:len(free)-1]
+		s.used[sl.block]++
+		return sl, nil
+	}
+
+	block, err := s.backing.AddBlock(&domain.Block{})
+	if err != nil {
+		return slot{}, err
+	}
+	if size == maxSlot {
+		return slot{block: block}, nil
+	}
+	for offset := maxSlot - size; offset > 0; offset -= size {
+		s.free[size] = append(s.free[size], slot{block, offset})
+	}
+	s.used[block] = 1
+	return slot{block: block}, nil
+}
+
+// release gives back a slot, and the backing block it is in once none of its slots are in use.
+func (s *Store) release(sl slot, size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size == maxSlot {
+		return s.backing.FreeBlock(sl.block)
+	}
+
+	s.used[sl.block]--
+	if s.used[sl.block] > 0 {
+		s.free[size] = append(s.free[size], sl)
+		return nil
+	}
+
+	delete(s.used, sl.block)
+	free := s.free[size][:0]
+	for _, f := range s.free[size] {
+		if f.block != sl.block {
+			free = append(free, f)
+		}
+	}
+	s.free[size] = free
+	return s.backing.FreeBlock(sl.block)
+}
+
+func (s *Store) write(id domain.Word, b *domain.Block) error {
+	newID, err := s.backing.WriteBlock(id, b)
+	if err != nil {
+		return err
+	}
+	if newID != id {
+		return domain.ErrMoved
+	}
+	return nil
+}
+
+func place(row []domain.Word) (slot, int) {
+	return slot{block: row[tableBlock], offset: int(row[tablePlace] >> 16)}, int(row[tablePlace] & 0xffff)
+}
+
+// pack appends the packed form of b to buf, which is empty for a block of zeros. It stops once it
+// is longer than a slot can be, as a block that long is kept unpacked.
+func pack(buf []byte, b *domain.Block) []byte {
+	n := len(b)
+	for n > 0 && b[n-1] == 0 {
+		n--
+	}
+	if n == 0 {
+		return buf
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(n))
+	for _, w := range b[:n] {
+		if len(buf) > maxSlot-binary.MaxVarintLen64 {
+			return buf
+		}
+		buf = binary.AppendUvarint(buf, uint64(w))
+	}
+	return buf
+}
+
+func unpack(b *domain.Block, buf []byte) error {
+	*b = domain.Block{}
+	n, k := binary.Uvarint(buf)
+	if k <= 0 || n > uint64(len(b)) {
+		return ErrCorrupt
+	}
+	buf = buf[k:]
+	for i := range b[:n] {
+		w, k := binary.Uvarint(buf)
+		if k <= 0 {
+			return ErrCorrupt
+		}
+		b[i] = domain.Word(w)
+		buf = buf[k:]
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package compress
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func full() *domain.Block {
+	var b domain.Block
+	for i := range b {
+		b[i] = ^domain.Word(i)
+	}
+	return &b
+}
+
+func TestSlots(t *testing.T) {
+	s, err := New(mem.New(), tree.New(3, 1, mem.New(), 0, 0))
+	require.Nil(t, err)
+
+	blocks := []*domain.Block{{}, {1, 2, 3}, {0, 0, 1 << 40}, full(), {5}}
+	var ids []domain.Word
+	for _, b := range blocks {
+		id, err := s.AddBlock(b)
+		require.Nil(t, err)
+		ids = append(ids, id)
+	}
+
+	var b domain.Block
+	for i, id := range ids {
+		require.Nil(t, s.ReadBlock(id, &b))
+		assert.Equal(t, *blocks[i], b)
+	}
+
+	// blocks change size and move between slots
+	for i, id := range ids {
+		_, err := s.WriteBlock(id, blocks[len(blocks)-1-i])
+		require.Nil(t, err)
+	}
+	for i, id := range ids {
+		require.Nil(t, s.ReadBlock(id, &b))
+		assert.Equal(t, *blocks[len(blocks)-1-i], b)
+	}
+
+	require.Nil(t, s.FreeBlock(ids[1]))
+	assert.ErrorIs(t, s.ReadBlock(ids[1], &b), io.ErrUnexpectedEOF)
+
+	// block 0 is reserved but can be written
+	require.Nil(t, s.ReadBlock(0, &b))
+	assert.Equal(t, domain.Block{}, b)
+	_, err = s.WriteBlock(0, &domain.Block{7})
+	require.Nil(t, err)
+	require.Nil(t, s.ReadBlock(0, &b))
+	assert.Equal(t, domain.Block{7}, b)
+}
+
+func TestTreeShrinks(t *testing.T) {
+	// the table is kept in the backing store, alongside the slots
+	backing := mem.New()
+	tableRoot, err := backing.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	table := tree.New(3, 1, backing, 0, tableRoot)
+	s, err := New(backing, table)
+	require.Nil(t, err)
+
+	root, err := s.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	tr := tree.New(2, 1, s, 0, root)
+	for k := domain.Word(1); k <= 3000; k++ {
+		require.Nil(t, tr.Put([]domain.Word{k, k % 7}))
+	}
+	for k := domain.Word(1); k <= 3000; k += 2 {
+		require.Nil(t, tr.Delete([]domain.Word{k}))
+	}
+
+	// the slots are found again by a store over the same table
+	reopened, err := New(backing, table)
+	require.Nil(t, err)
+	tr = tree.New(2, 1, reopened, tr.Depth(), tr.Root())
+	for k := domain.Word(3001); k <= 3500; k++ {
+		require.Nil(t, tr.Put([]domain.Word{k, k % 7}))
+	}
+	for k := domain.Word(1); k <= 3500; k++ {
+		row, err := tr.Get([]domain.Word{k})
+		if k%2 == 1 && k <= 3000 {
+			assert.ErrorIs(t, err, tree.ErrNotFound)
+			continue
+		}
+		require.Nil(t, err)
+		assert.Equal(t, []domain.Word{k, k % 7}, row)
+	}
+
+	// the same rows in an uncompressed store take more blocks, table and all
+	plain := mem.New()
+	root, err = plain.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	pt := tree.New(2, 1, plain, 0, root)
+	r := tr.GetRange(tree.Bound{}, tree.Bound{})
+	for r.Next() {
+		require.Nil(t, pt.Put(r.This()))
+	}
+	require.Nil(t, r.Err())
+
+	var b domain.Block
+	assert.Less(t, blocks(backing, &b), blocks(plain, &b))
+}
+
+// blocks counts the blocks a store has grown to, as a file would.
+func blocks(s *mem.Store, b *domain.Block) int {
+	n := 0
+	for id := domain.Word(0); s.ReadBlock(id, b) == nil; id += domain.WordSize {
+		n++
+	}
+	return n
+}
+
+// failingStore fails every write to it while fail is set.
+type failingStore struct {
+	*mem.Store
+	fail bool
+}
+
+func (s *failingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	if s.fail {
+		return 0, errors.New("simulated failure")
+	}
+	return s.Store.WriteBlock(id, b)
+}
+
+func TestWriteFailure(t *testing.T) {
+	backing := &failingStore{Store: mem.New()}
+	s, err := New(backing, tree.New(3, 1, mem.New(), 0, 0))
+	require.Nil(t, err)
+	id, err := s.AddBlock(&domain.Block{1, 2, 3})
+	require.Nil(t, err)
+	before := blocks(backing.Store, new(domain.Block))
+
+	// the block cannot move to a larger slot, so it stays in the one it has
+	backing.fail = true
+	_, err = s.WriteBlock(id, full())
+	assert.NotNil(t, err)
+	backing.fail = false
+
+	var b domain.Block
+	require.Nil(t, s.ReadBlock(id, &b))
+	assert.Equal(t, domain.Block{1, 2, 3}, b)
+
+	// the slot claimed for it was given back
+	_, err = s.WriteBlock(id, full())
+	require.Nil(t, err)
+	require.Nil(t, s.FreeBlock(id))
+	_, err = s.AddBlock(full())
+	require.Nil(t, err)
+	assert.Equal(t, before+1, blocks(backing.Store, &b))
+}
@@ -0,0 +1,399 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/tree"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	ErrKey      = errors.New("no key for generation")
+	ErrKeyInUse = errors.New("generation already has another key")
+	ErrAuth     = errors.New("block failed authentication")
+)
+
+// The seals tree has a row for each block written through the store: the block id, then the seal
+// the block was last written under, and then, until that write is known to have gone through, the
+// seal the block had before it, or zeros. A seal is the generation of the key the block is
+// encrypted under, the nonce and the authentication tag.
+const (
+	sealGen    = 1
+	sealNonce  = 2
+	sealTag    = sealNonce + chacha20poly1305.NonceSizeX/8
+	sealPrev   = sealTag + chacha20poly1305.Overhead/8
+	sealWidth  = 2*sealPrev - 1
+	sealedSize = domain.ByteSize + chacha20poly1305.Overhead
+)
+
+// Store encrypts the blocks of another store with XChaCha20-Poly1305, so that a block is as large
+// encrypted as it is in the clear. Each block is sealed with its id as associated data, so a block
+// moved to another id fails authentication. The nonce and tag of each block are kept in a tree of
+// thirteen columns keyed by the first. The tree is needed to decrypt any block, so its own blocks
+// are written in the clear, to a store other than this one.
+//
+// The seal of a block is stored before the block is written, and the seal it had before is kept
+// alongside until the write goes through, so that the block can be read under one or the other
+// whether or not it does.
+//
+// Keys are numbered by generation, which must not be zero. Blocks are written under the current
+// key and may be read under any key the store has been given. A block without a seal fails
+// authentication; blocks written to the backing store before it was encrypted have to be adopted
+// with Adopt before they can be read. It is safe for concurrent use.
+type Store struct {
+	backing domain.Store
+	seals   *tree.Tree
+
+	mu      sync.RWMutex
+	keys    map[domain.Word]generation
+	current domain.Word
+}
+
+type generation struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+// New gives a store that encrypts blocks kept in backing under key, as generation gen. The seals
+// of the blocks are kept in seals.
+func New(backing domain.Store, seals *tree.Tree, gen domain.Word, key []byte) (*Store, error) {
+	s := &Store{backing: backing, seals: seals, keys: map[domain.Word]generation{}}
+	err := s.Rotate(gen, key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AddKey gives the store a key that blocks may have been written under, as generation gen, without
+// writing anything under it. A generation the store already has may only be given the same key
+// again, or else ErrKeyInUse is returned.
+func (s *Store) AddKey(gen domain.Word, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addKey(gen, key)
+}
+
+// Rotate makes key the current key, as generation gen. Blocks already written stay under the key
+// they were written under until they are written again, or until Reencrypt is run.
+func (s *Store) Rotate(gen domain.Word, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.addKey(gen, key)
+	if err != nil {
+		return err
+	}
+	s.current = gen
+	return nil
+}
+
+func (s *Store) addKey(gen domain.Word, key []byte) error {
+	if gen == 0 {
+		return fmt.Errorf("generation 0: %w", ErrKey)
+	}
+	if g, ok := s.keys[gen]; ok {
+		if subtle.ConstantTimeCompare(g.key, key) == 0 {
+			return fmt.Errorf("generation %d: %w", gen, ErrKeyInUse)
+		}
+		return nil
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	s.keys[gen] = generation{key: append([]byte(nil), key...), aead: aead}
+	return nil
+}
+
+// Reencrypt writes every block that is under a key other than the current one again under the
+// current key, after which the other keys are no longer needed. It takes one block at a time, so it
+// may be run in the background while the store is in use. Should the backing store move a block,
+// which would leave whatever refers to the block pointing at its old id, domain.ErrMoved is
+// returned.
+func (s *Store) Reencrypt() error {
+	var stale []domain.Word
+
+	s.mu.RLock()
+	r := s.seals.GetRange(tree.Bound{}, tree.Bound{})
+	for r.Next() {
+		row := r.This()
+		if row[sealGen] != 0 && row[sealGen] != s.current {
+			stale = append(stale, row[0])
+		}
+	}
+	s.mu.RUnlock()
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range stale {
+		err := s.reencrypt(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) reencrypt(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the block may have been written or freed since it was found
+	row, err := s.seal(id)
+	if errors.Is(err, tree.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if row[sealGen] == s.current {
+		return nil
+	}
+	var b domain.Block
+	err = s.open(id, &b)
+	if err != nil {
+		return err
+	}
+	return s.rewrite(id, &b)
+}
+
+// Adopt encrypts a block that was written to the backing store before it was encrypted, so that it
+// can be read through the store. A block that already has a seal is left as it is. Should the
+// backing store move the block, domain.ErrMoved is returned.
+func (s *Store) Adopt(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.seal(id)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, tree.ErrNotFound) {
+		return err
+	}
+
+	var b domain.Block
+	err = s.backing.ReadBlock(id, &b)
+	if err != nil {
+		return err
+	}
+	return s.rewrite(id, &b)
+}
+
+// rewrite writes b under the current key as the block with the given id, which must stay where it
+// is.
+func (s *Store) rewrite(id domain.Word, b *domain.Block) error {
+	newID, err := s.write(id, b)
+	if err != nil {
+		return err
+	}
+	if newID != id {
+		return fmt.Errorf("block %d, now %d: %w", id, newID, domain.ErrMoved)
+	}
+	return nil
+}
+
+// ReadBlock reads and decrypts a block, returning an error that wraps ErrAuth if it has been
+// tampered with, or has no seal.
+func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.open(id, b)
+}
+
+func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the id is needed to seal the block, so the block is added empty and written after
+	id, err := s.backing.AddBlock(&domain.Block{})
+	if err != nil {
+		return 0, err
+	}
+	return s.write(id, b)
+}
+
+func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(id, b)
+}
+
+func (s *Store) FreeBlock(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.backing.FreeBlock(id)
+	if err != nil {
+		return err
+	}
+	return s.forget(id)
+}
+
+// open reads the block with the given id into b, decrypted under its last seal, or under the seal
+// before that if the last write of the block did not go through.
+func (s *Store) open(id domain.Word, b *domain.Block) error {
+	row, err := s.seal(id)
+	if errors.Is(err, tree.ErrNotFound) {
+		return fmt.Errorf("block %d has no seal: %w", id, ErrAuth)
+	}
+	if err != nil {
+		return err
+	}
+	var enc domain.Block
+	err = s.backing.ReadBlock(id, &enc)
+	if err != nil {
+		return err
+	}
+
+	err = s.unseal(id, b, &enc, row[sealGen:sealPrev])
+	if errors.Is(err, ErrAuth) && row[sealPrev] != 0 {
+		return s.unseal(id, b, &enc, row[sealPrev:])
+	}
+	return err
+}
+
+// unseal decrypts enc, the block with the given id as it is in the backing store, into b under the
+// given seal.
+func (s *Store) unseal(id domain.Word, b, enc *domain.Block, seal []domain.Word) error {
+	gen := seal[0]
+	g, ok := s.keys[gen]
+	if !ok {
+		return fmt.Errorf("block %d, generation %d: %w", id, gen, ErrKey)
+	}
+
+	var sealed [sealedSize]byte
+	copy(sealed[:], enc.Bytes())
+	putWords(sealed[domain.ByteSize:], seal[sealTag-sealGen:])
+	var nonce [chacha20poly1305.NonceSizeX]byte
+	putWords(nonce[:], seal[sealNonce-sealGen:sealTag-sealGen])
+
+	_, err := g.aead.Open(b.Bytes()[:0], nonce[:], sealed[:], additional(id))
+	if err != nil {
+		return fmt.Errorf("block %d: %w", id, ErrAuth)
+	}
+	return nil
+}
+
+// seal gives the seal of the block with the given id, or an error wrapping tree.ErrNotFound if it
+// has none.
+func (s *Store) seal(id domain.Word) ([]domain.Word, error) {
+	row, err := s.seals.Get([]domain.Word{id})
+	if err != nil {
+		return nil, err
+	}
+	if row[sealGen] == 0 {
+		// the zero row is in the tree from the start
+		return nil, tree.ErrNotFound
+	}
+	return row, nil
+}
+
+// write seals b under the current key and writes it. The seal is stored first, with the seal the
+// block is under kept behind it until the block has been written. If the backing store moves the
+// block, it is sealed again for its new id.
+func (s *Store) write(id domain.Word, b *domain.Block) (domain.Word, error) {
+	for {
+		var nonce [chacha20poly1305.NonceSizeX]byte
+		_, err := rand.Read(nonce[:])
+		if err != nil {
+			return 0, err
+		}
+
+		var sealed [sealedSize]byte
+		s.keys[s.current].aead.Seal(sealed[:0], nonce[:], b.Bytes(), additional(id))
+		var enc domain.Block
+		copy(enc.Bytes(), sealed[:domain.ByteSize])
+
+		row := make([]domain.Word, sealWidth)
+		row[0], row[sealGen] = id, s.current
+		getWords(row[sealNonce:sealTag], nonce[:])
+		getWords(row[sealTag:sealPrev], sealed[domain.ByteSize:])
+		prev, err := s.settled(id)
+		if err != nil {
+			return 0, err
+		}
+		copy(row[sealPrev:], prev)
+		err = s.seals.Put(row)
+		if err != nil {
+			return 0, err
+		}
+
+		newID, err := s.backing.WriteBlock(id, &enc)
+		if err != nil {
+			return 0, err
+		}
+		if newID == id {
+			clear(row[sealPrev:])
+			return id, s.seals.Put(row)
+		}
+		err = s.forget(id)
+		if err != nil {
+			return 0, err
+		}
+		id = newID
+	}
+}
+
+// settled gives the seal the block with the given id is under, or nil if it has none. If the last
+// write of the block is not known to have gone through, the block is read to find out which of its
+// two seals that is.
+func (s *Store) settled(id domain.Word) ([]domain.Word, error) {
+	row, err := s.seal(id)
+	if errors.Is(err, tree.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if row[sealPrev] == 0 {
+		return row[sealGen:sealPrev], nil
+	}
+
+	var enc, b domain.Block
+	err = s.backing.ReadBlock(id, &enc)
+	if err != nil {
+		return nil, err
+	}
+	err = s.unseal(id, &b, &enc, row[sealGen:sealPrev])
+	if errors.Is(err, ErrAuth) {
+		return row[sealPrev:], nil
+	}
+	return row[sealGen:sealPrev], err
+}
+
+func (s *Store) forget(id domain.Word) error {
+	err := s.seals.Delete([]domain.Word{id})
+	if errors.Is(err, tree.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func additional(id domain.Word) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(id))
+}
+
+func putWords(buf []byte, ws []domain.Word) {
+	for i, w := range ws {
+		binary.LittleEndian.PutUint64(buf[i*8:], uint64(w))
+	}
+}
+
+func getWords(ws []domain.Word, buf []byte) {
+	for i := range ws {
+		ws[i] = domain.Word(binary.LittleEndian.Uint64(buf[i*8:]))
+	}
+}
@@ -0,0 +1,243 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// encrypt gives a store over backing under key(1), whose seals are kept in a store of their own.
+func encrypt(t *testing.T, backing domain.Store) *Store {
+	s, err := New(backing, tree.New(sealWidth, 1, mem.New(), 0, 0), 1, key(1))
+	require.Nil(t, err)
+	return s
+}
+
+func TestEncrypted(t *testing.T) {
+	backing := mem.New()
+	s := encrypt(t, backing)
+
+	id, err := s.AddBlock(&domain.Block{1, 2, 3})
+	require.Nil(t, err)
+
+	var b domain.Block
+	require.Nil(t, backing.ReadBlock(id, &b))
+	assert.NotEqual(t, domain.Block{1, 2, 3}, b)
+
+	require.Nil(t, s.ReadBlock(id, &b))
+	assert.Equal(t, domain.Block{1, 2, 3}, b)
+
+	// blocks not written through the store are not taken as they are
+	assert.ErrorIs(t, s.ReadBlock(0, &b), ErrAuth)
+}
+
+func TestAdopt(t *testing.T) {
+	backing := mem.New()
+	plain, err := backing.AddBlock(&domain.Block{9})
+	require.Nil(t, err)
+	s := encrypt(t, backing)
+
+	var b domain.Block
+	assert.ErrorIs(t, s.ReadBlock(plain, &b), ErrAuth)
+	require.Nil(t, s.Adopt(plain))
+	require.Nil(t, s.ReadBlock(plain, &b))
+	assert.Equal(t, domain.Block{9}, b)
+	require.Nil(t, backing.ReadBlock(plain, &b))
+	assert.NotEqual(t, domain.Block{9}, b)
+
+	// adopting a block that is already encrypted leaves it alone
+	require.Nil(t, s.Adopt(plain))
+	require.Nil(t, s.ReadBlock(plain, &b))
+	assert.Equal(t, domain.Block{9}, b)
+}
+
+func TestTampered(t *testing.T) {
+	backing := mem.New()
+	s := encrypt(t, backing)
+
+	a, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	b, err := s.AddBlock(&domain.Block{2})
+	require.Nil(t, err)
+
+	var enc, got domain.Block
+	require.Nil(t, backing.ReadBlock(a, &enc))
+	enc[3] ^= 1
+	_, err = backing.WriteBlock(a, &enc)
+	require.Nil(t, err)
+	assert.ErrorIs(t, s.ReadBlock(a, &got), ErrAuth)
+
+	// a block copied to another id does not pass for the block there
+	require.Nil(t, backing.ReadBlock(b, &enc))
+	_, err = backing.WriteBlock(a, &enc)
+	require.Nil(t, err)
+	assert.ErrorIs(t, s.ReadBlock(a, &got), ErrAuth)
+}
+
+func TestRotate(t *testing.T) {
+	// the seals are kept in the backing store, in the clear
+	backing := mem.New()
+	sealsRoot, err := backing.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	s, err := New(backing, tree.New(sealWidth, 1, backing, 0, sealsRoot), 1, key(1))
+	require.Nil(t, err)
+
+	root, err := s.AddBlock(&domain.Block{})
+	require.Nil(t, err)
+	tr := tree.New(2, 1, s, 0, root)
+	for k := domain.Word(1); k <= 500; k++ {
+		require.Nil(t, tr.Put([]domain.Word{k, k * 3}))
+	}
+
+	assert.ErrorIs(t, s.Rotate(0, key(2)), ErrKey)
+	require.Nil(t, s.Rotate(2, key(2)))
+	assert.ErrorIs(t, s.AddKey(1, key(2)), ErrKeyInUse)
+	require.Nil(t, s.AddKey(2, key(2)))
+	for k := domain.Word(1); k <= 500; k += 7 {
+		require.Nil(t, tr.Put([]domain.Word{k, k * 5}))
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Reencrypt()
+	}()
+	for k := domain.Word(1); k <= 500; k += 11 {
+		require.Nil(t, tr.Put([]domain.Word{k, k * 7}))
+	}
+	require.Nil(t, <-done)
+
+	// the first key is no longer needed
+	reopened, err := New(backing, s.seals, 2, key(2))
+	require.Nil(t, err)
+	tr = tree.New(2, 1, reopened, tr.Depth(), tr.Root())
+	for k := domain.Word(1); k <= 500; k++ {
+		row, err := tr.Get([]domain.Word{k})
+		require.Nil(t, err)
+		want := k * 3
+		if k%11 == 1 {
+			want = k * 7
+		} else if k%7 == 1 {
+			want = k * 5
+		}
+		assert.Equal(t, []domain.Word{k, want}, row)
+	}
+
+	// nor can blocks under it be read without it
+	stale, err := New(backing, s.seals, 1, key(1))
+	require.Nil(t, err)
+	var b domain.Block
+	assert.ErrorIs(t, stale.ReadBlock(tr.Root(), &b), ErrKey)
+}
+
+// movingStore moves the next blocks written to it, as many as moves gives.
+type movingStore struct {
+	*mem.Store
+	moves int
+}
+
+func (s *movingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	if s.moves == 0 {
+		return s.Store.WriteBlock(id, b)
+	}
+	s.moves--
+	newID, err := s.Store.AddBlock(b)
+	if err != nil {
+		return 0, err
+	}
+	return newID, s.Store.FreeBlock(id)
+}
+
+func TestMoved(t *testing.T) {
+	backing := &movingStore{Store: mem.New()}
+	plain, err := backing.AddBlock(&domain.Block{9})
+	require.Nil(t, err)
+	s := encrypt(t, backing)
+	backing.moves = 1
+	assert.ErrorIs(t, s.Adopt(plain), domain.ErrMoved)
+
+	// a block written through the store follows it when it moves
+	backing.moves = 1
+	id, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	var b domain.Block
+	require.Nil(t, s.ReadBlock(id, &b))
+	assert.Equal(t, domain.Block{1}, b)
+
+	// but a block that Reencrypt moves is lost to whatever refers to it
+	require.Nil(t, s.Rotate(2, key(2)))
+	backing.moves = 1
+	assert.ErrorIs(t, s.Reencrypt(), domain.ErrMoved)
+}
+
+// failingStore fails every write once fail is set, after making it if through is set.
+type failingStore struct {
+	domain.Store
+	fail, through bool
+}
+
+func (s *failingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	if !s.fail {
+		return s.Store.WriteBlock(id, b)
+	}
+	if s.through {
+		_, err := s.Store.WriteBlock(id, b)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, errors.New("simulated failure")
+}
+
+func TestWriteFailure(t *testing.T) {
+	backing, seals := &failingStore{Store: mem.New()}, &failingStore{Store: mem.New()}
+	s, err := New(backing, tree.New(sealWidth, 1, seals, 0, 0), 1, key(1))
+	require.Nil(t, err)
+	id, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+
+	read := func() domain.Block {
+		var b domain.Block
+		require.Nil(t, s.ReadBlock(id, &b))
+		return b
+	}
+
+	// a write whose seal cannot be stored leaves the block as it was
+	seals.fail = true
+	_, err = s.WriteBlock(id, &domain.Block{2})
+	assert.NotNil(t, err)
+	seals.fail = false
+	assert.Equal(t, domain.Block{1}, read())
+
+	// as do writes that do not reach the backing store, however many there are
+	backing.fail = true
+	for i := 0; i < 3; i++ {
+		_, err = s.WriteBlock(id, &domain.Block{3})
+		assert.NotNil(t, err)
+		assert.Equal(t, domain.Block{1}, read())
+	}
+
+	// and a write that does, but fails after, is read as it was written
+	backing.through = true
+	_, err = s.WriteBlock(id, &domain.Block{4})
+	assert.NotNil(t, err)
+	assert.Equal(t, domain.Block{4}, read())
+
+	// once a write goes through, only its seal is kept
+	backing.fail = false
+	_, err = s.WriteBlock(id, &domain.Block{5})
+	require.Nil(t, err)
+	assert.Equal(t, domain.Block{5}, read())
+	row, err := s.seals.Get([]domain.Word{id})
+	require.Nil(t, err)
+	assert.Equal(t, make([]domain.Word, sealWidth-sealPrev), row[sealPrev:])
+}
@@ -1,13 +1,34 @@
 package file
 
 import (
+	"errors"
 	"io"
 	"io/fs"
+	"sync"
 
 	"github.com/catlev/pkg/domain"
 )
 
+var (
+	ErrBadHeader = errors.New("file does not start with a block store header")
+	ErrNotEmpty  = errors.New("file to upgrade into is not empty")
+)
+
+// The file starts with a header block, and the block with id n follows at offset n+512, so that
+// ids are spaced out as offsets are. The header holds a magic number, the id of the last block in
+// the file and the id of the first free block. Each free block holds the id of the next in its
+// first word, with 0 marking the end of the list, which is why block 0 is never handed out.
+const (
+	magic       = 0xca7b10c5f11e0001
+	headerSize  = domain.ByteSize
+	headerMagic = 0
+	headerMaxID = 1
+	headerFree  = 2
+)
+
+// Store keeps blocks in a file. It is safe for concurrent use.
 type Store struct {
+	mu    sync.RWMutex
 	f     File
 	maxID domain.Word
 	free  domain.Word
@@ -20,59 +41,213 @@ type File interface {
 	Stat() (fs.FileInfo, error)
 }
 
+// New gives a store over the blocks in f, carrying on from where the last store over f left off.
+// Block 0 is reserved, as in a store from mem.New. If f is empty, it is given a header and a block
+// 0 of zeros. If f does not start with a header, ErrBadHeader is returned; a file written before
+// stores had a header has to be upgraded with Upgrade first.
 func New(f File) (*Store, error) {
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	return &Store{
-		f:     f,
-		maxID: domain.Word(fi.Size() - domain.ByteSize),
-	}, nil
+
+	s := &Store{f: f}
+	if fi.Size() == 0 {
+		// the file is written from the start, as some files cannot be written past their end
+		err = s.writeHeader()
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.WriteAt(new(domain.Block).Bytes(), headerSize)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	var h domain.Block
+	_, err = f.ReadAt(h.Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if h[headerMagic] != magic {
+		return nil, ErrBadHeader
+	}
+	s.maxID = h[headerMaxID]
+	s.free = h[headerFree]
+	return s, nil
+}
+
+// Upgrade copies the blocks of legacy, a file written before stores had a header, which holds its
+// blocks from offset 0, into f, which must be empty, and gives a store over f. Its free blocks,
+// which such a file never kept, are lost. Legacy is only read, and the header is written to f last,
+// so should the upgrade be interrupted, New fails on f with ErrBadHeader and the upgrade can be run
+// again once f has been emptied. If legacy is not of that kind, ErrBadHeader is returned.
+func Upgrade(legacy, f File) (*Store, error) {
+	fi, err := legacy.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 || size%domain.ByteSize != 0 {
+		return nil, ErrBadHeader
+	}
+	var b domain.Block
+	_, err = legacy.ReadAt(b.Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if b[headerMagic] == magic {
+		return nil, ErrBadHeader
+	}
+
+	fi, err = f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != 0 {
+		return nil, ErrNotEmpty
+	}
+
+	// the file is written from the start, with a header of zeros until the blocks are all there
+	_, err = f.WriteAt(new(domain.Block).Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+	for off := int64(0); off < size; off += domain.ByteSize {
+		_, err = legacy.ReadAt(b.Bytes(), off)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.WriteAt(b.Bytes(), off+headerSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &Store{f: f, maxID: domain.Word(size - domain.ByteSize)}
+	err = s.writeHeader()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readBlock(id, b)
+}
+
+func (s *Store) readBlock(id domain.Word, b *domain.Block) error {
 	if id > s.maxID {
 		return io.ErrUnexpectedEOF
 	}
 
-	_, err := s.f.ReadAt(b.Bytes(), int64(id))
+	_, err := s.f.ReadAt(b.Bytes(), int64(id)+headerSize)
 	return err
 }
 
 func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeBlock(id, b)
+}
+
+func (s *Store) writeBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
 	if id > s.maxID {
 		return 0, io.ErrUnexpectedEOF
 	}
 
-	_, err := s.f.WriteAt(b.Bytes(), int64(id))
+	_, err := s.f.WriteAt(b.Bytes(), int64(id)+headerSize)
 	return id, err
 }
 
+// AddBlock takes the first block of the free list if there is one, or else adds a block to the end
+// of the file. Either way, the header is written before the block's contents, so that if writing
+// the contents fails, the block is lost rather than handed out twice. If writing the header fails,
+// the store is left as it was.
 func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maxID, free := s.maxID, s.free
+	var id domain.Word
 	if s.free == 0 {
 		s.maxID += domain.ByteSize
-		_, err := s.f.WriteAt(b.Bytes(), int64(s.maxID))
-		return s.maxID, err
+		id = s.maxID
+	} else {
+		var bb domain.Block
+		id = s.free
+		err := s.readBlock(id, &bb)
+		if err != nil {
+			return 0, err
+		}
+		s.free = bb[0]
 	}
-	var bb domain.Block
-	id := s.free
-	err := s.ReadBlock(id, &bb)
+
+	err := s.writeHeader()
 	if err != nil {
+		s.maxID, s.free = maxID, free
 		return 0, err
 	}
-	s.free = bb[0]
-	_, err = s.f.WriteAt(b.Bytes(), int64(s.maxID))
+	_, err = s.writeBlock(id, b)
 	return id, err
 }
 
+// FreeBlock puts the block at the head of the free list. The block is linked to the rest of the
+// list before the header is written, so that the list on disk is whole at every point. If writing
+// the header fails, the block is not freed.
 func (s *Store) FreeBlock(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var b domain.Block
 	b[0] = s.free
-	_, err := s.WriteBlock(id, &b)
+	_, err := s.writeBlock(id, &b)
 	if err != nil {
 		return err
 	}
+	free := s.free
 	s.free = id
-	return nil
+	err = s.writeHeader()
+	if err != nil {
+		s.free = free
+	}
+	return err
+}
+
+// Allocated lists the blocks in the file that are not on the free list, in order, including block
+// 0.
+func (s *Store) Allocated() ([]domain.Word, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	free := map[domain.Word]bool{}
+	for id := s.free; id != 0; {
+		var b domain.Block
+		err := s.readBlock(id, &b)
+		if err != nil {
+			return nil, err
+		}
+		free[id] = true
+		id = b[0]
+	}
+	var ids []domain.Word
+	for id := domain.Word(0); id <= s.maxID; id += domain.ByteSize {
+		if !free[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *Store) writeHeader() error {
+	var h domain.Block
+	h[headerMagic] = magic
+	h[headerMaxID] = s.maxID
+	h[headerFree] = s.free
+	_, err := s.f.WriteAt(h.Bytes(), 0)
+	return err
 }
@@ -0,0 +1,201 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T, path string) (*Store, *os.File) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	require.Nil(t, err)
+	s, err := New(f)
+	require.Nil(t, err)
+	return s, f
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks")
+
+	s, f := openStore(t, path)
+	var b domain.Block
+	require.Nil(t, s.ReadBlock(0, &b))
+	assert.Equal(t, domain.Block{}, b)
+
+	var ids []domain.Word
+	for i := domain.Word(1); i <= 5; i++ {
+		id, err := s.AddBlock(&domain.Block{i})
+		require.Nil(t, err)
+		assert.NotZero(t, id)
+		ids = append(ids, id)
+	}
+	require.Nil(t, s.FreeBlock(ids[1]))
+	require.Nil(t, s.FreeBlock(ids[3]))
+	require.Nil(t, f.Close())
+
+	s, f = openStore(t, path)
+	defer f.Close()
+
+	require.Nil(t, s.ReadBlock(ids[4], &b))
+	assert.Equal(t, domain.Word(5), b[0])
+
+	// the freed blocks are handed out again, and then the file grows
+	var added []domain.Word
+	for i := 0; i < 3; i++ {
+		id, err := s.AddBlock(&domain.Block{7})
+		require.Nil(t, err)
+		added = append(added, id)
+	}
+	assert.Equal(t, []domain.Word{ids[3], ids[1], ids[4] + domain.ByteSize}, added)
+
+	allocated, err := s.Allocated()
+	require.Nil(t, err)
+	assert.Equal(t, append([]domain.Word{0}, append(ids, added[2])...), allocated)
+
+	// the header, block 0 and six more
+	fi, err := f.Stat()
+	require.Nil(t, err)
+	assert.Equal(t, int64(8*domain.ByteSize), fi.Size())
+
+	err = s.ReadBlock(added[2]+domain.ByteSize, &b)
+	assert.NotNil(t, err)
+}
+
+func TestBadHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks")
+	require.Nil(t, os.WriteFile(path, make([]byte, domain.ByteSize+100), 0644))
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	_, err = New(f)
+	assert.ErrorIs(t, err, ErrBadHeader)
+}
+
+func TestReuseFreed(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "blocks"))
+	require.Nil(t, err)
+	defer f.Close()
+	s, err := New(f)
+	require.Nil(t, err)
+
+	a, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	b, err := s.AddBlock(&domain.Block{2})
+	require.Nil(t, err)
+	require.Nil(t, s.FreeBlock(a))
+
+	c, err := s.AddBlock(&domain.Block{3})
+	require.Nil(t, err)
+	assert.Equal(t, a, c)
+
+	// the reused block is written where it lives, and not over the last block in the file
+	var got domain.Block
+	require.Nil(t, s.ReadBlock(c, &got))
+	assert.Equal(t, domain.Block{3}, got)
+	require.Nil(t, s.ReadBlock(b, &got))
+	assert.Equal(t, domain.Block{2}, got)
+}
+
+func TestUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "blocks")
+
+	// a file from before the header: block 0, then blocks 512 and 1024
+	var legacy []byte
+	for i := domain.Word(0); i < 3; i++ {
+		legacy = append(legacy, (&domain.Block{i, i}).Bytes()...)
+	}
+	require.Nil(t, os.WriteFile(path, legacy, 0644))
+
+	// the file is not rewritten just by opening it
+	old, err := os.Open(path)
+	require.Nil(t, err)
+	defer old.Close()
+	_, err = New(old)
+	assert.ErrorIs(t, err, ErrBadHeader)
+	got, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, legacy, got)
+
+	// an upgrade that stops part way leaves a file that cannot be opened, and can be run again
+	upgraded := filepath.Join(dir, "upgraded")
+	f, err := os.Create(upgraded)
+	require.Nil(t, err)
+	_, err = Upgrade(old, &failingFile{File: f, failAt: 2 * domain.ByteSize})
+	assert.NotNil(t, err)
+	_, err = New(f)
+	assert.ErrorIs(t, err, ErrBadHeader)
+	_, err = Upgrade(old, f)
+	assert.ErrorIs(t, err, ErrNotEmpty)
+	require.Nil(t, f.Truncate(0))
+
+	s, err := Upgrade(old, f)
+	require.Nil(t, err)
+	var b domain.Block
+	for i := domain.Word(0); i < 3; i++ {
+		require.Nil(t, s.ReadBlock(i*domain.ByteSize, &b))
+		assert.Equal(t, domain.Block{i, i}, b)
+	}
+	require.Nil(t, f.Close())
+
+	s, f = openStore(t, upgraded)
+	defer f.Close()
+	require.Nil(t, s.ReadBlock(2*domain.ByteSize, &b))
+	assert.Equal(t, domain.Block{2, 2}, b)
+	id, err := s.AddBlock(&domain.Block{3})
+	require.Nil(t, err)
+	assert.Equal(t, domain.Word(3*domain.ByteSize), id)
+
+	// a file that already has a header is not upgraded
+	_, err = Upgrade(f, &failingFile{})
+	assert.ErrorIs(t, err, ErrBadHeader)
+}
+
+// failingFile fails every write to the header once fail is set, and every write at or past failAt
+// where that is set.
+type failingFile struct {
+	*os.File
+	fail   bool
+	failAt int64
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.fail && off == 0 || f.failAt != 0 && off >= f.failAt {
+		return 0, errors.New("simulated failure")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestHeaderFailure(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "blocks"))
+	require.Nil(t, err)
+	defer file.Close()
+	f := &failingFile{File: file}
+	s, err := New(f)
+	require.Nil(t, err)
+
+	a, err := s.AddBlock(&domain.Block{1})
+	require.Nil(t, err)
+	b, err := s.AddBlock(&domain.Block{2})
+	require.Nil(t, err)
+
+	f.fail = true
+	_, err = s.AddBlock(&domain.Block{3})
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.FreeBlock(a))
+
+	// neither the failed add nor the failed free is remembered
+	f.fail = false
+	c, err := s.AddBlock(&domain.Block{3})
+	require.Nil(t, err)
+	assert.Equal(t, b+domain.ByteSize, c)
+
+	var got domain.Block
+	assert.NotNil(t, s.ReadBlock(c+domain.ByteSize, &got))
+}
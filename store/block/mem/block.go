@@ -2,21 +2,27 @@ package mem
 
 import (
 	"io"
+	"sync"
 
 	"github.com/catlev/pkg/domain"
 )
 
+// Store keeps blocks in memory. It is safe for concurrent use.
 type Store struct {
+	mu     sync.RWMutex
 	blocks []domain.Word
 	free   []domain.Word
 }
 
 func New() *Store {
-	return &Store{make([]domain.Word, domain.WordSize), nil}
+	return &Store{blocks: make([]domain.Word, domain.WordSize)}
 }
 
 func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
-	if int(id) > len(s.blocks)-domain.WordSize {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id > domain.Word(len(s.blocks)-domain.WordSize) {
 		return io.ErrUnexpectedEOF
 	}
 
@@ -25,6 +31,9 @@ func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
 }
 
 func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var id domain.Word
 
 	if len(s.free) != 0 {
@@ -40,11 +49,35 @@ func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
 }
 
 func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	copy(s.blocks[id:], (*b)[:])
 	return id, nil
 }
 
 func (s *Store) FreeBlock(id domain.Word) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.free = append(s.free, id)
 	return nil
 }
+
+// Allocated lists the blocks in the store that are not free, in order, including block 0.
+func (s *Store) Allocated() ([]domain.Word, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	free := map[domain.Word]bool{}
+	for _, id := range s.free {
+		free[id] = true
+	}
+	var ids []domain.Word
+	for id := domain.Word(0); id < domain.Word(len(s.blocks)); id += domain.WordSize {
+		if !free[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
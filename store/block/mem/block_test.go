@@ -18,6 +18,17 @@ func TestReadEOF(t *testing.T) {
 	}
 }
 
+func TestReadFar(t *testing.T) {
+	store := New()
+
+	var b domain.Block
+	err := store.ReadBlock(1<<63, &b)
+
+	if err == nil {
+		t.Fail()
+	}
+}
+
 func TestRead(t *testing.T) {
 	store := New()
 	store.blocks[2] = 4
@@ -71,3 +82,19 @@ func TestFree(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestAllocated(t *testing.T) {
+	store := New()
+
+	a, _ := store.AddBlock(new(domain.Block))
+	b, _ := store.AddBlock(new(domain.Block))
+	store.FreeBlock(a)
+	ids, err := store.Allocated()
+
+	if err != nil {
+		t.Error(err)
+	}
+	if len(ids) != 2 || ids[0] != 0 || ids[1] != b {
+		t.Errorf("got %v", ids)
+	}
+}
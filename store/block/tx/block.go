@@ -0,0 +1,197 @@
+package tx
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+
+	"github.com/catlev/pkg/domain"
+	blockfile "github.com/catlev/pkg/store/block/file"
+	"github.com/catlev/pkg/store/file"
+)
+
+var (
+	ErrInTx = errors.New("a unit of work is already under way")
+	ErrNoTx = errors.New("no unit of work is under way")
+)
+
+// Store keeps blocks in a journaled file, laid out as a store from the file block store would lay
+// them out. Between Begin and Commit, every block written, by any goroutine, is part of a single
+// transaction on the file, so that a mutation of a tree, or of several, is made all at once or not
+// at all. Blocks written outside of a unit of work are each written in a transaction of their own.
+//
+// Until it is committed, a unit of work is visible only through the store. Once it is rolled back,
+// anything that holds ids given out during it, or roots written during it, such as a tree or a
+// catalog, has to be opened again. It is safe for concurrent use.
+type Store struct {
+	file *file.File
+
+	// mu guards blocks, and is held throughout Begin, Commit and Rollback
+	mu     sync.Mutex
+	blocks *blockfile.Store
+
+	// stage guards tx and staged, which are only changed while mu is held too, so that staging
+	// never needs mu
+	stage sync.Mutex
+	tx    *file.Tx
+	// staged holds the blocks written during the unit of work, by offset in the file
+	staged map[int64]*domain.Block
+}
+
+// New gives a store over f, which is set up as the file block store sets up an empty file.
+func New(f *file.File) (*Store, error) {
+	s := &Store{file: f}
+	blocks, err := blockfile.New(staging{s})
+	if err != nil {
+		return nil, err
+	}
+	s.blocks = blocks
+	return s, nil
+}
+
+// Begin starts a unit of work.
+func (s *Store) Begin() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tx != nil {
+		return ErrInTx
+	}
+	tx, err := s.file.Begin()
+	if err != nil {
+		return err
+	}
+	s.stage.Lock()
+	s.tx = tx
+	s.staged = map[int64]*domain.Block{}
+	s.stage.Unlock()
+	return nil
+}
+
+// Commit makes the unit of work under way part of the file. Should that fail, the unit of work is
+// rolled back.
+func (s *Store) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tx == nil {
+		return ErrNoTx
+	}
+	s.stage.Lock()
+	err := s.tx.Commit()
+	s.stage.Unlock()
+	if err != nil {
+		return errors.Join(err, s.rollback())
+	}
+
+	s.stage.Lock()
+	defer s.stage.Unlock()
+	err = s.tx.Close()
+	s.tx, s.staged = nil, nil
+	return err
+}
+
+// Rollback abandons the unit of work under way, leaving the file as it was before Begin.
+func (s *Store) Rollback() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tx == nil {
+		return ErrNoTx
+	}
+	return s.rollback()
+}
+
+func (s *Store) rollback() error {
+	s.stage.Lock()
+	err := s.tx.Rollback()
+	s.tx, s.staged = nil, nil
+	s.stage.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the free list and size of the store are as the header in the file has them
+	blocks, err := blockfile.New(staging{s})
+	if err != nil {
+		return err
+	}
+	s.blocks = blocks
+	return nil
+}
+
+// Do runs fn as a unit of work, which is committed if fn succeeds and rolled back if it fails. If
+// the commit fails, the unit of work is rolled back all the same.
+func (s *Store) Do(fn func() error) error {
+	err := s.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		return errors.Join(err, s.Rollback())
+	}
+	return s.Commit()
+}
+
+func (s *Store) ReadBlock(id domain.Word, b *domain.Block) error {
+	return s.current().ReadBlock(id, b)
+}
+
+func (s *Store) AddBlock(b *domain.Block) (domain.Word, error) {
+	return s.current().AddBlock(b)
+}
+
+func (s *Store) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	return s.current().WriteBlock(id, b)
+}
+
+func (s *Store) FreeBlock(id domain.Word) error {
+	return s.current().FreeBlock(id)
+}
+
+func (s *Store) current() *blockfile.Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.blocks
+}
+
+// staging is the file under the file block store. It stages writes in the unit of work under way,
+// if there is one, and reads back what has been staged.
+type staging struct {
+	s *Store
+}
+
+func (f staging) ReadAt(buf []byte, pos int64) (int, error) {
+	f.s.stage.Lock()
+	b, ok := f.s.staged[pos]
+	f.s.stage.Unlock()
+
+	if ok && len(buf) == domain.ByteSize {
+		return copy(buf, b.Bytes()), nil
+	}
+	return f.s.file.ReadAt(buf, pos)
+}
+
+func (f staging) WriteAt(buf []byte, pos int64) (int, error) {
+	f.s.stage.Lock()
+	defer f.s.stage.Unlock()
+
+	if f.s.tx == nil {
+		return f.s.file.WriteAt(buf, pos)
+	}
+
+	n, err := f.s.tx.WriteAt(buf, pos)
+	if err != nil || len(buf) != domain.ByteSize {
+		return n, err
+	}
+	var b domain.Block
+	copy(b.Bytes(), buf)
+	f.s.staged[pos] = &b
+	return n, nil
+}
+
+func (f staging) Stat() (fs.FileInfo, error) {
+	return f.s.file.Stat()
+}
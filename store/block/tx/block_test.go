@@ -0,0 +1,148 @@
+package tx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/catalog"
+	"github.com/catlev/pkg/store/file"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T, name string) (*Store, *file.File) {
+	f, err := file.Open(name)
+	require.Nil(t, err)
+	s, err := New(f)
+	require.Nil(t, err)
+	return s, f
+}
+
+func put(tr *tree.Tree, from, to int) error {
+	for k := from; k < to; k++ {
+		err := tr.Put([]domain.Word{domain.Word(k), domain.Word(k * 2)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func assertRows(t *testing.T, s *Store, n int) {
+	t.Helper()
+
+	c, err := catalog.Open(s)
+	require.Nil(t, err)
+	tr, err := c.Tree("t")
+	require.Nil(t, err)
+
+	count, err := tr.Count(tree.Exclusive([]domain.Word{0}), tree.Bound{})
+	require.Nil(t, err)
+	assert.Equal(t, n, count)
+	problems, err := tree.Verify(tr)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestUnitOfWork(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "db")
+	require.Nil(t, os.WriteFile(name, nil, 0644))
+
+	s, f := openStore(t, name)
+	c, err := catalog.Open(s)
+	require.Nil(t, err)
+	tr, err := c.Create("t", catalog.Descriptor{Columns: 2, Key: 1})
+	require.Nil(t, err)
+
+	require.Nil(t, s.Do(func() error {
+		return put(tr, 1, 100)
+	}))
+
+	// a failed unit of work leaves nothing behind, even though the tree has grown a level
+	fail := errors.New("fail")
+	depth := tr.Depth()
+	err = s.Do(func() error {
+		err := put(tr, 100, 5000)
+		if err != nil {
+			return err
+		}
+		return fail
+	})
+	assert.ErrorIs(t, err, fail)
+	assert.Greater(t, tr.Depth(), depth)
+	assertRows(t, s, 99)
+
+	// the tree has to be opened again after a rollback
+	c, err = catalog.Open(s)
+	require.Nil(t, err)
+	tr, err = c.Tree("t")
+	require.Nil(t, err)
+	require.Nil(t, s.Begin())
+	assert.ErrorIs(t, s.Begin(), ErrInTx)
+	require.Nil(t, tr.Delete([]domain.Word{50}))
+	require.Nil(t, s.Commit())
+	assert.ErrorIs(t, s.Commit(), ErrNoTx)
+	require.Nil(t, f.Close())
+
+	s, f = openStore(t, name)
+	defer f.Close()
+	assertRows(t, s, 98)
+}
+
+func TestUncommitted(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "db")
+	require.Nil(t, os.WriteFile(name, nil, 0644))
+
+	s, f := openStore(t, name)
+	c, err := catalog.Open(s)
+	require.Nil(t, err)
+	tr, err := c.Create("t", catalog.Descriptor{Columns: 2, Key: 1})
+	require.Nil(t, err)
+
+	require.Nil(t, s.Begin())
+	require.Nil(t, put(tr, 1, 1000))
+	// the unit of work can be read back through the store, but isn't in the file yet
+	assertRows(t, s, 999)
+	fi, err := f.Stat()
+	require.Nil(t, err)
+	assert.Equal(t, int64(3*domain.ByteSize), fi.Size())
+
+	// a crash before the commit loses the unit of work
+	require.Nil(t, f.Close())
+	s, f = openStore(t, name)
+	defer f.Close()
+	assertRows(t, s, 0)
+}
+
+func TestFailedCommit(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "db")
+	require.Nil(t, os.WriteFile(name, nil, 0644))
+
+	s, f := openStore(t, name)
+	c, err := catalog.Open(s)
+	require.Nil(t, err)
+	tr, err := c.Create("t", catalog.Descriptor{Columns: 2, Key: 1})
+	require.Nil(t, err)
+	require.Nil(t, s.Do(func() error {
+		return put(tr, 1, 100)
+	}))
+
+	// with the file closed under it, the commit fails once the journal is written
+	err = s.Do(func() error {
+		err := put(tr, 100, 200)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	})
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, s.Commit(), ErrNoTx)
+
+	s, f = openStore(t, name)
+	defer f.Close()
+	assertRows(t, s, 99)
+}
@@ -0,0 +1,297 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/tree"
+)
+
+var (
+	ErrNotCatalog = errors.New("block 0 does not hold a catalog")
+	ErrNotFound   = errors.New("no such tree")
+	ErrExists     = errors.New("tree already exists")
+	ErrName       = errors.New("tree name must be 1 to 24 bytes, without NUL")
+	ErrFull       = errors.New("catalog is full")
+	ErrDescriptor = errors.New("bad tree descriptor")
+)
+
+// The catalog lives in block 0 of the store, which block stores keep back for the purpose. The
+// first word of the block holds a magic number in the high half and the number of trees in the
+// low half. Each tree then takes six words: three for its name, one for its shape, and one each
+// for its depth and root. Since the whole catalog is written as one block, a change to it is made
+// all at once or not at all.
+const (
+	catalogID = 0
+	magic     = 0xca7a1097 << 32
+
+	nameWords  = 3
+	entryWords = nameWords + 3
+	maxEntries = (domain.WordSize - 1) / entryWords
+)
+
+// The shape word gives the number of columns in the low 16 bits, the number of key columns in the
+// next 16, and the options the tree was created with above those.
+const (
+	flagCopyOnWrite = 1 << (32 + iota)
+	flagCompressKeys
+	flagCounted
+	flagOverflow
+
+	knownFlags = flagCopyOnWrite | flagCompressKeys | flagCounted | flagOverflow
+)
+
+// A Descriptor gives the shape of a tree, and the options it is kept with.
+type Descriptor struct {
+	Columns      int
+	Key          int
+	CopyOnWrite  bool
+	CompressKeys bool
+	Counted      bool
+	Overflow     bool
+}
+
+// A Catalog keeps track of the trees in a block store by name, so that they can be found again
+// when the store is reopened. It is safe for concurrent use.
+type Catalog struct {
+	mu      sync.Mutex
+	store   domain.Store
+	entries []*entry
+	trees   map[string]*tree.Tree
+}
+
+type entry struct {
+	name  string
+	desc  Descriptor
+	depth int
+	root  domain.Word
+}
+
+// Open reads the catalog of a block store. A store whose block 0 is still all zeros has an empty
+// catalog. An entry that could not have been written by Create gives ErrDescriptor.
+func Open(store domain.Store) (*Catalog, error) {
+	var b domain.Block
+	err := store.ReadBlock(catalogID, &b)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Catalog{
+		store: store,
+		trees: map[string]*tree.Tree{},
+	}
+	if b[0] == 0 {
+		return c, nil
+	}
+
+	count := int(b[0] & 0xffffffff)
+	if b[0]&^0xffffffff != magic || count > maxEntries {
+		return nil, ErrNotCatalog
+	}
+	for i := 0; i < count; i++ {
+		e, err := decodeEntry(b[1+i*entryWords:])
+		if err != nil {
+			return nil, err
+		}
+		c.entries = append(c.entries, e)
+	}
+
+	return c, nil
+}
+
+// Names gives the names of the trees in the catalog, in the order they were created.
+func (c *Catalog) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, len(c.entries))
+	for i, e := range c.entries {
+		names[i] = e.name
+	}
+	return names
+}
+
+// Describe gives the descriptor of the named tree.
+func (c *Catalog) Describe(name string) (Descriptor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.find(name)
+	if e == nil {
+		return Descriptor{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return e.desc, nil
+}
+
+// Create adds an empty tree to the catalog, and gives it back ready for use. Options that the
+// descriptor cannot express, such as collations, are passed to the tree, and must be passed again
+// whenever it is opened. Errors may originate from the block store.
+func (c *Catalog) Create(name string, d Descriptor, opts ...tree.Option) (*tree.Tree, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case !validName(name):
+		return nil, fmt.Errorf("%q: %w", name, ErrName)
+	case !d.valid():
+		return nil, fmt.Errorf("%s: %w", name, ErrDescriptor)
+	case c.find(name) != nil:
+		return nil, fmt.Errorf("%s: %w", name, ErrExists)
+	case len(c.entries) == maxEntries:
+		return nil, fmt.Errorf("%s: %w", name, ErrFull)
+	}
+
+	root, err := c.store.AddBlock(&domain.Block{})
+	if err != nil {
+		return nil, err
+	}
+
+	e := &entry{name: name, desc: d, root: root}
+	c.entries = append(c.entries, e)
+	err = c.write()
+	if err != nil {
+		c.entries = c.entries[:len(c.entries)-1]
+		return nil, errors.Join(err, c.store.FreeBlock(root))
+	}
+
+	return c.open(e, opts), nil
+}
+
+// Tree gives the named tree, as of the last change made to it. The same tree is given each time
+// it is asked for, so that there is only ever one writer. Options are only used the first time.
+func (c *Catalog) Tree(name string, opts ...tree.Option) (*tree.Tree, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.trees[name]; ok {
+		return t, nil
+	}
+	e := c.find(name)
+	if e == nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return c.open(e, opts), nil
+}
+
+func (c *Catalog) open(e *entry, opts []tree.Option) *tree.Tree {
+	var all []tree.Option
+	if e.desc.CopyOnWrite {
+		all = append(all, tree.CopyOnWrite())
+	}
+	if e.desc.CompressKeys {
+		all = append(all, tree.CompressKeys())
+	}
+	if e.desc.Counted {
+		all = append(all, tree.Counted())
+	}
+	if e.desc.Overflow {
+		all = append(all, tree.Overflow())
+	}
+	all = append(all, opts...)
+	all = append(all, tree.OnRoot(func(root domain.Word, depth int) error {
+		return c.update(e, root, depth)
+	}))
+
+	t := tree.New(e.desc.Columns, e.desc.Key, c.store, e.depth, e.root, all...)
+	c.trees[e.name] = t
+	return t
+}
+
+// update records a new root and depth for a tree, writing out the catalog.
+func (c *Catalog) update(e *entry, root domain.Word, depth int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.root, e.depth = root, depth
+	return c.write()
+}
+
+func (c *Catalog) find(name string) *entry {
+	for _, e := range c.entries {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) write() error {
+	var b domain.Block
+	b[0] = magic | domain.Word(len(c.entries))
+	for i, e := range c.entries {
+		e.encode(b[1+i*entryWords:])
+	}
+	_, err := c.store.WriteBlock(catalogID, &b)
+	return err
+}
+
+func (e *entry) encode(ws []domain.Word) {
+	for i := 0; i < len(e.name); i++ {
+		ws[i/8] |= domain.Word(e.name[i]) << (8 * (i % 8))
+	}
+
+	shape := domain.Word(e.desc.Columns) | domain.Word(e.desc.Key)<<16
+	if e.desc.CopyOnWrite {
+		shape |= flagCopyOnWrite
+	}
+	if e.desc.CompressKeys {
+		shape |= flagCompressKeys
+	}
+	if e.desc.Counted {
+		shape |= flagCounted
+	}
+	if e.desc.Overflow {
+		shape |= flagOverflow
+	}
+	ws[nameWords] = shape
+	ws[nameWords+1] = domain.Word(e.depth)
+	ws[nameWords+2] = e.root
+}
+
+func (d Descriptor) valid() bool {
+	return d.Key >= 1 && d.Columns >= d.Key && d.Columns <= 0xffff
+}
+
+func decodeEntry(ws []domain.Word) (*entry, error) {
+	var name []byte
+	for i := 0; i < nameWords*8; i++ {
+		ch := byte(ws[i/8] >> (8 * (i % 8)))
+		if ch == 0 {
+			break
+		}
+		name = append(name, ch)
+	}
+
+	shape := ws[nameWords]
+	e := &entry{
+		name: string(name),
+		desc: Descriptor{
+			Columns:      int(shape & 0xffff),
+			Key:          int(shape >> 16 & 0xffff),
+			CopyOnWrite:  shape&flagCopyOnWrite != 0,
+			CompressKeys: shape&flagCompressKeys != 0,
+			Counted:      shape&flagCounted != 0,
+			Overflow:     shape&flagOverflow != 0,
+		},
+		depth: int(ws[nameWords+1]),
+		root:  ws[nameWords+2],
+	}
+	if !validName(e.name) || !e.desc.valid() || shape>>32<<32&^knownFlags != 0 {
+		return nil, fmt.Errorf("%q: %w", e.name, ErrDescriptor)
+	}
+	return e, nil
+}
+
+func validName(name string) bool {
+	if len(name) == 0 || len(name) > nameWords*8 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package catalog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/file"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fill(t *testing.T, tr *tree.Tree, n int) {
+	for i := 1; i <= n; i++ {
+		k := domain.Word(i)
+		require.Nil(t, tr.Put([]domain.Word{k, k * 10, k * 100}))
+	}
+}
+
+func assertFilled(t *testing.T, tr *tree.Tree, n int) {
+	for i := 1; i <= n; i++ {
+		k := domain.Word(i)
+		row, err := tr.Get([]domain.Word{k})
+		require.Nil(t, err)
+		assert.Equal(t, []domain.Word{k, k * 10, k * 100}, row)
+	}
+	problems, err := tree.Verify(tr)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestCatalog(t *testing.T) {
+	store := mem.New()
+
+	c, err := Open(store)
+	require.Nil(t, err)
+	assert.Empty(t, c.Names())
+
+	person, err := c.Create("person", Descriptor{Columns: 3, Key: 1, Counted: true})
+	require.Nil(t, err)
+	_, err = c.Create("place", Descriptor{Columns: 2, Key: 2, CompressKeys: true})
+	require.Nil(t, err)
+	fill(t, person, 1000)
+
+	same, err := c.Tree("person")
+	require.Nil(t, err)
+	assert.Same(t, person, same)
+
+	reopened, err := Open(store)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"person", "place"}, reopened.Names())
+
+	d, err := reopened.Describe("person")
+	require.Nil(t, err)
+	assert.Equal(t, Descriptor{Columns: 3, Key: 1, Counted: true}, d)
+
+	tr, err := reopened.Tree("person")
+	require.Nil(t, err)
+	assert.Equal(t, person.Root(), tr.Root())
+	assert.Equal(t, person.Depth(), tr.Depth())
+	assertFilled(t, tr, 1000)
+
+	tr, err = reopened.Tree("nobody")
+	assert.Nil(t, tr)
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestCatalogOverflow(t *testing.T) {
+	store := mem.New()
+	c, err := Open(store)
+	require.Nil(t, err)
+
+	wide := func(k domain.Word) []domain.Word {
+		row := make([]domain.Word, 40)
+		for i := range row {
+			row[i] = k + domain.Word(i)
+		}
+		return row
+	}
+	tr, err := c.Create("wide", Descriptor{Columns: 40, Key: 1, Overflow: true})
+	require.Nil(t, err)
+	for k := domain.Word(1); k <= 200; k++ {
+		require.Nil(t, tr.Put(wide(k)))
+	}
+
+	reopened, err := Open(store)
+	require.Nil(t, err)
+	d, err := reopened.Describe("wide")
+	require.Nil(t, err)
+	assert.True(t, d.Overflow)
+	tr, err = reopened.Tree("wide")
+	require.Nil(t, err)
+	for k := domain.Word(1); k <= 200; k++ {
+		row, err := tr.Get([]domain.Word{k})
+		require.Nil(t, err)
+		assert.Equal(t, wide(k), row)
+	}
+}
+
+func TestCatalogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+
+	f, err := os.Create(path)
+	require.Nil(t, err)
+	store, err := file.New(f)
+	require.Nil(t, err)
+	c, err := Open(store)
+	require.Nil(t, err)
+	tr, err := c.Create("person", Descriptor{Columns: 3, Key: 1, CopyOnWrite: true})
+	require.Nil(t, err)
+	fill(t, tr, 500)
+	require.Nil(t, f.Close())
+
+	f, err = os.OpenFile(path, os.O_RDWR, 0)
+	require.Nil(t, err)
+	defer f.Close()
+	store, err = file.New(f)
+	require.Nil(t, err)
+	c, err = Open(store)
+	require.Nil(t, err)
+	tr, err = c.Tree("person")
+	require.Nil(t, err)
+	assertFilled(t, tr, 500)
+}
+
+func TestCreateErrors(t *testing.T) {
+	c, err := Open(mem.New())
+	require.Nil(t, err)
+
+	_, err = c.Create("", Descriptor{Columns: 1, Key: 1})
+	assert.True(t, errors.Is(err, ErrName))
+	_, err = c.Create("a name that is far too long", Descriptor{Columns: 1, Key: 1})
+	assert.True(t, errors.Is(err, ErrName))
+	_, err = c.Create("t", Descriptor{Columns: 1, Key: 2})
+	assert.True(t, errors.Is(err, ErrDescriptor))
+
+	for i := 0; i < maxEntries; i++ {
+		_, err = c.Create(string(rune('a'+i)), Descriptor{Columns: 1, Key: 1})
+		require.Nil(t, err)
+	}
+	_, err = c.Create("a", Descriptor{Columns: 1, Key: 1})
+	assert.True(t, errors.Is(err, ErrExists))
+	_, err = c.Create("z", Descriptor{Columns: 1, Key: 1})
+	assert.True(t, errors.Is(err, ErrFull))
+}
+
+func TestNotCatalog(t *testing.T) {
+	store := mem.New()
+	_, err := store.WriteBlock(0, &domain.Block{1, 2, 3})
+	require.Nil(t, err)
+
+	_, err = Open(store)
+	assert.True(t, errors.Is(err, ErrNotCatalog))
+}
+
+func TestBadDescriptor(t *testing.T) {
+	for _, shape := range []domain.Word{
+		2,                 // no key
+		3 | 4<<16,         // more key columns than columns
+		3 | 1<<16 | 1<<40, // an option that is not known
+	} {
+		store := mem.New()
+		_, err := store.WriteBlock(0, &domain.Block{magic | 1, 't', 0, 0, shape})
+		require.Nil(t, err)
+
+		_, err = Open(store)
+		assert.True(t, errors.Is(err, ErrDescriptor), "shape %x", shape)
+	}
+}
+
+// failingStore fails to write the catalog while fail is set, and counts the blocks in use.
+type failingStore struct {
+	*mem.Store
+	fail bool
+	live int
+}
+
+func (s *failingStore) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.live++
+	return s.Store.AddBlock(b)
+}
+
+func (s *failingStore) FreeBlock(id domain.Word) error {
+	s.live--
+	return s.Store.FreeBlock(id)
+}
+
+func (s *failingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	if s.fail && id == catalogID {
+		return 0, errors.New("simulated failure")
+	}
+	return s.Store.WriteBlock(id, b)
+}
+
+func TestCreateFailure(t *testing.T) {
+	store := &failingStore{Store: mem.New(), fail: true}
+	c, err := Open(store)
+	require.Nil(t, err)
+
+	_, err = c.Create("t", Descriptor{Columns: 2, Key: 1})
+	assert.NotNil(t, err)
+	assert.Zero(t, store.live)
+	assert.Empty(t, c.Names())
+}
@@ -0,0 +1,295 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/model"
+	"github.com/catlev/pkg/path/eval"
+	"github.com/catlev/pkg/store/tree"
+)
+
+var (
+	ErrNoKey         = errors.New("no identifying attributes")
+	ErrUnknownEntity = errors.New("unknown entity type")
+	ErrUnknownIndex  = errors.New("unknown index")
+)
+
+// Store keeps the entities of a model in trees. Each entity type has a tree keyed by its
+// identifying attributes, along with a tree for each of its indexes, which is kept up to date as
+// entities are written. A write to an entity and to its indexes is not atomic: if the block store
+// fails part way through, the indexes may have to be rebuilt.
+type Store struct {
+	model  *model.EntityModel
+	tables []*table
+}
+
+type table struct {
+	entityID domain.Word
+	rows     *tree.Tree
+	key      int
+	indexes  []*index
+}
+
+type index struct {
+	columns []int
+	rows    *tree.Tree
+}
+
+var _ eval.IndexStore = (*Store)(nil)
+
+// New creates the trees for the entity types of a model in a block store. Types without
+// attributes, such as value types, have no tree. The identifying attributes of a type must come
+// before the others. Options are passed on to every tree.
+func New(m *model.EntityModel, store domain.Store, opts ...tree.Option) (*Store, error) {
+	s := &Store{
+		model:  m,
+		tables: make([]*table, len(m.Types)),
+	}
+
+	newTree := func(columns, key int) (*tree.Tree, error) {
+		root, err := store.AddBlock(&domain.Block{})
+		if err != nil {
+			return nil, err
+		}
+		all := opts
+		if columns > domain.WordSize/4 {
+			// rows this wide would leave too few to a leaf
+			all = append(all[:len(all):len(all)], tree.Overflow())
+		}
+		return tree.New(columns, key, store, 0, root, all...), nil
+	}
+
+	for id, t := range m.Types {
+		if t.Kind == model.Value || len(t.Attributes) == 0 {
+			continue
+		}
+
+		key := 0
+		for key < len(t.Attributes) && t.Attributes[key].Identifying {
+			key++
+		}
+		if key == 0 {
+			return nil, fmt.Errorf("%s: %w", t.Name, ErrNoKey)
+		}
+
+		rows, err := newTree(len(t.Attributes), key)
+		if err != nil {
+			return nil, err
+		}
+		tab := &table{
+			entityID: domain.Word(id),
+			rows:     rows,
+			key:      key,
+		}
+
+		for _, idx := range t.Indexes {
+			// an index row holds the indexed values followed by the key of the entity
+			width := len(idx.Columns) + key
+			rows, err := newTree(width, width)
+			if err != nil {
+				return nil, err
+			}
+			tab.indexes = append(tab.indexes, &index{
+				columns: idx.Columns,
+				rows:    rows,
+			})
+		}
+
+		s.tables[id] = tab
+	}
+
+	return s, nil
+}
+
+func (s *Store) table(entityID domain.Word) (*table, error) {
+	if int(entityID) >= len(s.tables) || s.tables[entityID] == nil {
+		return nil, fmt.Errorf("%d: %w", entityID, ErrUnknownEntity)
+	}
+	return s.tables[entityID], nil
+}
+
+// Put writes an entity, given the values of all of its attributes, replacing any entity with the
+// same identifying attributes. The identifying attributes may not all be zero, as trees keep a row
+// for the zero key of their own.
+func (s *Store) Put(entityID domain.Word, fields []domain.Word) error {
+	t, err := s.table(entityID)
+	if err != nil {
+		return err
+	}
+	if len(fields) < t.key || isZero(fields[:t.key]) {
+		return tree.ErrBadRow
+	}
+
+	var old []domain.Word
+	err = t.rows.Update(fields[:t.key], func(row []domain.Word) ([]domain.Word, bool) {
+		old = row
+		return fields, true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range t.indexes {
+		entry := idx.entry(fields, t.key)
+		if old != nil {
+			prev := idx.entry(old, t.key)
+			if slices.Equal(prev, entry) {
+				continue
+			}
+			err = idx.rows.Delete(prev)
+			if err != nil {
+				return err
+			}
+		}
+		err = idx.rows.Put(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the entity with the given identifying attributes. If there is none,
+// tree.ErrNotFound is returned.
+func (s *Store) Delete(entityID domain.Word, key []domain.Word) error {
+	t, err := s.table(entityID)
+	if err != nil {
+		return err
+	}
+
+	var old []domain.Word
+	err = t.rows.Update(key, func(row []domain.Word) ([]domain.Word, bool) {
+		old = row
+		return nil, true
+	})
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return tree.ErrNotFound
+	}
+
+	for _, idx := range t.indexes {
+		err = idx.rows.Delete(idx.entry(old, t.key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindEntities gives the entities whose identifying attributes start with key.
+func (s *Store) FindEntities(entityID domain.Word, key []domain.Word) eval.Cursor {
+	t, err := s.table(entityID)
+	if err != nil {
+		return &cursor{err: err}
+	}
+	return &cursor{
+		entityID: entityID,
+		rows:     t.rows.Scan(key),
+		key:      t.key,
+	}
+}
+
+// FindIndexed gives the entities whose values for the columns of an index start with values.
+func (s *Store) FindIndexed(entityID domain.Word, index int, values []domain.Word) eval.Cursor {
+	t, err := s.table(entityID)
+	if err != nil {
+		return &cursor{err: err}
+	}
+	if index < 0 || index >= len(t.indexes) {
+		return &cursor{err: fmt.Errorf("%d: %w", index, ErrUnknownIndex)}
+	}
+	idx := t.indexes[index]
+	return &cursor{
+		entityID: entityID,
+		rows:     idx.rows.Scan(values),
+		table:    t.rows,
+		skip:     len(idx.columns),
+		key:      t.key,
+	}
+}
+
+// ParseValue reads a value of one of the built-in value types.
+func (s *Store) ParseValue(valueID domain.Word, value string) (domain.Word, error) {
+	switch valueID {
+	case model.IntegerID:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, err
+		}
+		return domain.Word(i), nil
+	default:
+		return 0, fmt.Errorf("%d: %w", valueID, model.ErrUnknownType)
+	}
+}
+
+// entry gives the row of the index for an entity.
+func (idx *index) entry(fields []domain.Word, key int) []domain.Word {
+	entry := make([]domain.Word, 0, len(idx.columns)+key)
+	for _, c := range idx.columns {
+		entry = append(entry, fields[c])
+	}
+	return append(entry, fields[:key]...)
+}
+
+func isZero(key []domain.Word) bool {
+	for _, w := range key {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A cursor gives entities from a range of a tree. When the range is over an index, the entities
+// are looked up in their table by the key that follows the indexed values.
+type cursor struct {
+	entityID domain.Word
+	rows     *tree.Range
+	table    *tree.Tree
+	// the key of the entity is the key columns after the first skip
+	skip, key int
+	this      []domain.Word
+	err       error
+}
+
+func (c *cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	for c.rows.Next() {
+		c.this = c.rows.This()
+		key := c.this[c.skip : c.skip+c.key]
+		if isZero(key) {
+			// the row the tree keeps for the zero key is not an entity
+			continue
+		}
+		if c.table == nil {
+			return true
+		}
+
+		c.this, c.err = c.table.Get(key)
+		return c.err == nil
+	}
+	return false
+}
+
+func (c *cursor) This() eval.Object {
+	return eval.Object{
+		EntityID: c.entityID,
+		Fields:   c.this,
+	}
+}
+
+func (c *cursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.rows.Err()
+}
@@ -0,0 +1,128 @@
+package entity
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/model"
+	"github.com/catlev/pkg/path/eval"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/catlev/pkg/store/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const personID = 3
+
+func testModel() *model.EntityModel {
+	return &model.EntityModel{
+		Types: []model.Type{
+			model.IntegerID: {
+				ID:   model.IntegerID,
+				Kind: model.Value,
+			},
+			personID: {
+				ID:   personID,
+				Name: "person",
+				Attributes: model.Attributes{
+					{Name: "id", Identifying: true, Type: model.IntegerID},
+					{Name: "rank", Type: model.IntegerID},
+					{Name: "size", Type: model.IntegerID},
+				},
+				Indexes: model.Indexes{
+					{Columns: []int{1}},
+					{Columns: []int{2, 1}},
+				},
+			},
+		},
+	}
+}
+
+func collect(t *testing.T, c eval.Cursor) [][]domain.Word {
+	var rows [][]domain.Word
+	for c.Next() {
+		rows = append(rows, c.This().Fields)
+	}
+	require.Nil(t, c.Err())
+	return rows
+}
+
+func TestIndexes(t *testing.T) {
+	s, err := New(testModel(), mem.New())
+	require.Nil(t, err)
+
+	require.Nil(t, s.Put(personID, []domain.Word{1, 10, 5}))
+	require.Nil(t, s.Put(personID, []domain.Word{2, 20, 5}))
+	require.Nil(t, s.Put(personID, []domain.Word{3, 10, 6}))
+
+	assert.Equal(t, [][]domain.Word{{1, 10, 5}, {3, 10, 6}}, collect(t, s.FindIndexed(personID, 0, []domain.Word{10})))
+	assert.Equal(t, [][]domain.Word{{1, 10, 5}, {2, 20, 5}}, collect(t, s.FindIndexed(personID, 1, []domain.Word{5})))
+
+	// moving an entity moves its index entries
+	require.Nil(t, s.Put(personID, []domain.Word{1, 20, 5}))
+	assert.Equal(t, [][]domain.Word{{3, 10, 6}}, collect(t, s.FindIndexed(personID, 0, []domain.Word{10})))
+	assert.Equal(t, [][]domain.Word{{1, 20, 5}, {2, 20, 5}}, collect(t, s.FindIndexed(personID, 0, []domain.Word{20})))
+
+	require.Nil(t, s.Delete(personID, []domain.Word{2}))
+	assert.Equal(t, [][]domain.Word{{1, 20, 5}}, collect(t, s.FindIndexed(personID, 1, []domain.Word{5})))
+	assert.True(t, errors.Is(s.Delete(personID, []domain.Word{2}), tree.ErrNotFound))
+
+	assert.Equal(t, [][]domain.Word{{1, 20, 5}, {3, 10, 6}}, collect(t, s.FindEntities(personID, nil)))
+	assert.Equal(t, [][]domain.Word{{3, 10, 6}}, collect(t, s.FindEntities(personID, []domain.Word{3})))
+}
+
+func TestPutErrors(t *testing.T) {
+	s, err := New(testModel(), mem.New())
+	require.Nil(t, err)
+
+	assert.True(t, errors.Is(s.Put(personID, []domain.Word{0, 1, 1}), tree.ErrBadRow))
+	assert.True(t, errors.Is(s.Put(personID, []domain.Word{1, 1}), tree.ErrBadRow))
+	assert.True(t, errors.Is(s.Put(model.IntegerID, []domain.Word{1}), ErrUnknownEntity))
+	assert.True(t, errors.Is(s.FindIndexed(personID, 2, nil).Err(), ErrUnknownIndex))
+
+	m := testModel()
+	m.Types[personID].Attributes[0].Identifying = false
+	_, err = New(m, mem.New())
+	assert.True(t, errors.Is(err, ErrNoKey))
+}
+
+// countingStore notes which ways of finding entities are used.
+type countingStore struct {
+	*Store
+	scans, lookups int
+}
+
+func (s *countingStore) FindEntities(entityID domain.Word, key []domain.Word) eval.Cursor {
+	s.scans++
+	return s.Store.FindEntities(entityID, key)
+}
+
+func (s *countingStore) FindIndexed(entityID domain.Word, index int, values []domain.Word) eval.Cursor {
+	s.lookups++
+	return s.Store.FindIndexed(entityID, index, values)
+}
+
+func TestEvalUsesIndex(t *testing.T) {
+	m := testModel()
+	inner, err := New(m, mem.New())
+	require.Nil(t, err)
+	for i := domain.Word(1); i <= 100; i++ {
+		require.Nil(t, inner.Put(personID, []domain.Word{i, i % 10, i}))
+	}
+
+	s := &countingStore{Store: inner}
+	h := eval.NewHost(m, s)
+	b := h.Eval(h.Absolute(), "3/~rank/size")
+
+	var sizes []domain.Word
+	c := b.Enumerate()
+	for c.Next() {
+		sizes = append(sizes, c.This().Fields[0])
+	}
+	require.Nil(t, c.Err())
+
+	assert.Equal(t, []domain.Word{3, 13, 23, 33, 43, 53, 63, 73, 83, 93}, sizes)
+	assert.Equal(t, 0, s.scans)
+	assert.Equal(t, 1, s.lookups)
+}
@@ -27,6 +27,9 @@ type Tx struct {
 	oldSize int64
 	newSize int64
 	journal *journal
+	// applied is set once Commit begins to change the file
+	applied bool
+	closed  bool
 }
 
 type underlyingFile interface {
@@ -159,6 +162,7 @@ func (f *Tx) WriteAt(buf []byte, pos int64) (int, error) {
 	if pos > f.newSize {
 		return 0, ErrWriteAfterEnd
 	}
+	f.newSize = max(f.newSize, pos+int64(len(buf)))
 
 	// Split the operations into updates and appends to simplify the logic that interprets the
 	// journal files.
@@ -229,6 +233,7 @@ func (f *Tx) Commit() error {
 
 	// At this point we can begin actually making changes to the file. If we are interrupted at any
 	// point in this process, whatever changes have been made will be undone during recovery.
+	f.applied = true
 	err = f.journal.Apply(f.file.file)
 	if err != nil {
 		return err
@@ -248,10 +253,43 @@ func (f *Tx) Commit() error {
 }
 
 func (f *Tx) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
 	f.file.tx.Unlock()
 	return f.journal.Close()
 }
 
+// Rollback abandons the transaction and closes it. If a failed Commit has already begun to change
+// the file, the changes are undone from the journal, just as they would be by recovery when the
+// file is opened; should that fail, the journal is kept so that recovery can try again.
+func (f *Tx) Rollback() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	defer f.file.tx.Unlock()
+
+	if f.applied {
+		err := f.journal.Recover(f.file.file)
+		if err != nil {
+			return errors.Join(err, f.journal.file.Close())
+		}
+	}
+
+	err := f.journal.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(f.journal.file.Name())
+	if errors.Is(err, os.ErrNotExist) {
+		// Commit got as far as removing the journal
+		return nil
+	}
+	return err
+}
+
 func (f *Tx) stageUpdate(buf []byte, pos int64) error {
 	if len(buf) == 0 {
 		return nil
@@ -1,6 +1,10 @@
 package file
 
 import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -150,3 +154,74 @@ func writeWithBrokenJournal(t *testing.T, f *File, b []byte) {
 	err = f.Close()
 	require.Nil(t, err)
 }
+
+func TestRollback(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "eg")
+	require.Nil(t, os.WriteFile(name, []byte{1, 2, 3}, 0644))
+	f := aFileNamed(t, name)
+	defer f.Close()
+
+	tx, err := f.Begin()
+	require.Nil(t, err)
+	_, err = tx.WriteAt([]byte{4, 5, 6}, 0)
+	require.Nil(t, err)
+	require.Nil(t, tx.Rollback())
+	require.Nil(t, tx.Close())
+	fileHasContents(t, f, []byte{1, 2, 3})
+
+	// with the journal gone, the next transaction can begin straight away
+	tx, err = f.Begin()
+	require.Nil(t, err)
+	_, err = tx.WriteAt([]byte{7, 8, 9}, 3)
+	require.Nil(t, err)
+	_, err = tx.WriteAt([]byte{10}, 6)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	require.Nil(t, tx.Close())
+
+	buf := make([]byte, 7)
+	_, err = f.ReadAt(buf, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 7, 8, 9, 10}, buf)
+}
+
+// failingFile fails every write once it has made the number of writes left.
+type failingFile struct {
+	*os.File
+	left int
+}
+
+func (f *failingFile) WriteAt(buf []byte, pos int64) (int, error) {
+	f.left--
+	if f.left < 0 {
+		return 0, errors.New("simulated failure")
+	}
+	return f.File.WriteAt(buf, pos)
+}
+
+func TestRollbackFailedCommit(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "eg")
+	require.Nil(t, os.WriteFile(name, []byte{1, 2, 3}, 0644))
+	of, err := os.OpenFile(name, os.O_RDWR, 0644)
+	require.Nil(t, err)
+	ff := &failingFile{File: of, left: 1}
+	f := &File{file: ff}
+	defer f.Close()
+
+	tx, err := f.Begin()
+	require.Nil(t, err)
+	_, err = tx.WriteAt([]byte{4}, 0)
+	require.Nil(t, err)
+	_, err = tx.WriteAt([]byte{5, 6}, 1)
+	require.Nil(t, err)
+
+	// the first change reaches the file before the second fails
+	assert.NotNil(t, tx.Commit())
+	fileHasContents(t, f, []byte{4, 2, 3})
+
+	ff.left = math.MaxInt
+	require.Nil(t, tx.Rollback())
+	fileHasContents(t, f, []byte{1, 2, 3})
+	_, err = os.Stat(name + ".journal")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
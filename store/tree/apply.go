@@ -0,0 +1,358 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// A Batch collects puts and deletes to be applied to a tree together.
+type Batch struct {
+	muts []mutation
+}
+
+// A mutation puts row if it is set, and deletes key otherwise.
+type mutation struct {
+	key, row []domain.Word
+}
+
+// Put adds a put of the given row to the batch.
+func (b *Batch) Put(row []domain.Word) {
+	row = append([]domain.Word(nil), row...)
+	b.muts = append(b.muts, mutation{row: row})
+}
+
+// Delete adds a delete of the given key to the batch.
+func (b *Batch) Delete(key []domain.Word) {
+	key = append([]domain.Word(nil), key...)
+	b.muts = append(b.muts, mutation{key: key})
+}
+
+// Apply makes the changes in the batch in key order, so that each leaf is found once and the changes
+// that fall in it are made together. Only a change that splits the leaf, or leaves it short of rows,
+// is made as Put or Delete would make it, after which the leaf for the next change is found again.
+// Where the batch changes a key more than once, the last change wins, and deleting a key that is
+// not in the tree does nothing. The nodes changed, and the overflow chains written, are held back until
+// the end, when each is written once, to a new block. If an error stops the batch before they have
+// all been written, the tree is left as it was. Errors may originate from the block store.
+func (t *Tree) Apply(b *Batch) (err error) {
+	defer wrapErr(&err, "Apply", nil)
+
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	for _, m := range b.muts {
+		switch {
+		case m.row != nil && len(m.row) != t.columns:
+			return ErrBadRow
+		case m.row == nil && len(m.key) != t.key:
+			return ErrKeyWidth
+		}
+	}
+
+	muts := make([]mutation, len(b.muts))
+	for i, m := range b.muts {
+		muts[i] = mutation{key: t.encodeKey(m.key), row: t.encodeRow(m.row)}
+	}
+	sort.SliceStable(muts, func(i, j int) bool {
+		return t.order.compare(muts[i].keyOf(t), muts[j].keyOf(t)) > 0
+	})
+
+	t.beginWrite()
+	defer t.endWrite(&err)
+
+	root, depth := t.root, t.depth
+	t.staging = &staging{blocks: map[domain.Word]*stagedBlock{}}
+	defer func() {
+		if t.staging != nil {
+			t.staging = nil
+			t.root, t.depth = root, depth
+		}
+	}()
+
+	// n is the leaf the changes are being made in, high the key that the next leaf starts with, and
+	// pending whether n has changes not yet written
+	var n *node
+	var high []domain.Word
+	pending := false
+	for i, m := range muts {
+		key := m.keyOf(t)
+		if i+1 < len(muts) && compareValues(key, muts[i+1].keyOf(t)) == 0 {
+			// superseded by a later change
+			continue
+		}
+		if n != nil && high != nil && t.order.compare(key, high) <= 0 {
+			if pending {
+				err = t.writeNode(n)
+				if err != nil {
+					return err
+				}
+			}
+			n, pending = nil, false
+		}
+		if n == nil {
+			n, err = t.findNode(t.working(), key)
+			if err != nil {
+				return err
+			}
+			high = n.upperBound()
+		}
+
+		var changed, stale bool
+		changed, stale, err = t.applyAt(n, m)
+		if err != nil {
+			return err
+		}
+		if stale {
+			n, pending = nil, false
+		} else {
+			pending = pending || changed
+		}
+	}
+	if pending {
+		err = t.writeNode(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.flush()
+}
+
+// applyAt makes the change m in the leaf n that its key falls in. A change that leaves n within its
+// bounds is only made in memory, and reported as changed, for n to be written once the changes that
+// fall in it are all made. Any other is made as put and delete make it, which writes n and leaves
+// it stale.
+func (t *Tree) applyAt(n *node, m mutation) (changed, stale bool, err error) {
+	key := m.keyOf(t)
+	idx := n.probe(key)
+	found := n.compareKeyAt(idx, key) == 0
+
+	if m.row == nil {
+		switch {
+		case !found:
+			return false, false, nil
+		case n.parent != nil && n.width <= n.minWidth():
+			return false, true, t.deleteAt(n, idx)
+		}
+		stored := append([]domain.Word(nil), n.getRow(idx)...)
+		n.remove(idx, 1)
+		return true, false, t.freeRow(stored)
+	}
+
+	if found {
+		prev := append([]domain.Word(nil), n.getRow(idx)...)
+		changed, err = t.replaceRow(n, idx, m.row)
+		if err != nil || !changed {
+			return false, false, err
+		}
+		return true, false, t.freeRow(prev)
+	}
+
+	stored, err := t.storeRow(m.row)
+	if err != nil {
+		return false, false, err
+	}
+	if n.compareKeyAt(idx, key) >= 0 {
+		// the first row of a leaf may hold a key above the one that led to the leaf
+		idx++
+	}
+	n.insert(idx, stored)
+	if n.fits() {
+		return true, false, nil
+	}
+	_, err = t.splitNode(n, key)
+	return false, true, err
+}
+
+// upperBound gives the key that the leaf after n starts with, or nil if n is the last leaf.
+func (n *node) upperBound() []domain.Word {
+	for ; n.parent != nil; n = n.parent {
+		if n.pos+1 < n.parent.width {
+			return append([]domain.Word(nil), n.parent.getKey(n.pos+1)...)
+		}
+	}
+	return nil
+}
+
+func (m mutation) keyOf(t *Tree) []domain.Word {
+	if m.row != nil {
+		return m.row[:t.key]
+	}
+	return m.key
+}
+
+// stagedID marks the ids given to nodes while a batch is applied, which stand in for the ids they
+// will have once they are written.
+const stagedID domain.Word = 1 << 63
+
+// While a batch is applied, every node and overflow block written is kept in staging, under a
+// staged id, and the nodes above it take up the staged id in turn. Blocks freed are kept from the
+// store until the end too, as the tree before the batch may still need them.
+type staging struct {
+	blocks map[domain.Word]*stagedBlock
+	next   domain.Word
+	freed  []domain.Word
+}
+
+type stagedBlock struct {
+	block domain.Block
+	leaf  bool
+	chain bool
+	// orig is the id the node had before the batch, unless it is new.
+	orig  domain.Word
+	isNew bool
+}
+
+// stage keeps n, encoded as b, in staging, giving the staged id it has there.
+func (t *Tree) stage(n *node, b *domain.Block, isNew bool) domain.Word {
+	s := t.staging
+	id := n.id
+	if isNew || id&stagedID == 0 {
+		s.next++
+		id = stagedID | s.next
+		s.blocks[id] = &stagedBlock{
+			leaf:  n.leaf,
+			orig:  n.id,
+			isNew: isNew,
+		}
+	}
+	s.blocks[id].block = *b
+	return id
+}
+
+// stageChain keeps a block of an overflow chain in staging, giving the staged id it has there.
+func (s *staging) stageChain(b *domain.Block) domain.Word {
+	s.next++
+	id := stagedID | s.next
+	s.blocks[id] = &stagedBlock{block: *b, chain: true, isNew: true}
+	return id
+}
+
+func (s *staging) free(id domain.Word) {
+	if id&stagedID != 0 {
+		b := s.blocks[id]
+		delete(s.blocks, id)
+		if b.isNew {
+			return
+		}
+		id = b.orig
+	}
+	s.freed = append(s.freed, id)
+}
+
+// flush writes the staged blocks, each once, to new blocks, so that the blocks of the tree as it was
+// before the batch are untouched until every one has been written. Only then is staging left, and
+// are the blocks that the batch has finished with freed. A block can only be written once the
+// blocks it refers to have been, as until then it does not know their ids. Should a write fail,
+// the blocks already written are freed.
+func (t *Tree) flush() (err error) {
+	s := t.staging
+
+	var pending []domain.Word
+	for id := range s.blocks {
+		pending = append(pending, id)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i] < pending[j] })
+
+	written := map[domain.Word]domain.Word{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, id := range written {
+			delete(t.fresh, id)
+			err = errors.Join(err, t.store.FreeBlock(id))
+		}
+	}()
+
+	for len(pending) > 0 {
+		var waiting []domain.Word
+		for _, id := range pending {
+			b := s.blocks[id]
+			ok, err := t.resolve(b, written)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				waiting = append(waiting, id)
+				continue
+			}
+
+			written[id], err = t.addBlock(&b.block)
+			if err != nil {
+				delete(written, id)
+				return err
+			}
+		}
+		if len(waiting) == len(pending) {
+			// the blocks left refer to one another, or to staged blocks that are gone
+			return fmt.Errorf("%d staged blocks cannot be written: %w", len(waiting), ErrBadNode)
+		}
+		pending = waiting
+	}
+
+	t.staging = nil
+	if t.root&stagedID != 0 {
+		t.root = written[t.root]
+	}
+
+	freed := s.freed
+	for _, b := range s.blocks {
+		if !b.isNew {
+			freed = append(freed, b.orig)
+		}
+	}
+	for _, id := range freed {
+		err := t.freeBlock(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve replaces the staged ids that b refers to with the ids they were written under, reporting
+// whether it could replace them all. Interior nodes refer to their children, the leaves of a tree
+// with overflow chains to the chains, and each block of a chain to the next.
+func (t *Tree) resolve(b *stagedBlock, written map[domain.Word]domain.Word) (bool, error) {
+	if b.chain {
+		if b.block[0]&stagedID == 0 {
+			return true, nil
+		}
+		id, ok := written[b.block[0]]
+		b.block[0] = id
+		return ok, nil
+	}
+	if b.leaf && !t.overflow {
+		return true, nil
+	}
+
+	n := t.newNode(b.leaf)
+	err := n.decode(&b.block)
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < n.width; i++ {
+		row := n.getRow(i)
+		if row[t.key]&stagedID == 0 {
+			continue
+		}
+		id, ok := written[row[t.key]]
+		if !ok {
+			return false, nil
+		}
+		row[t.key] = id
+	}
+
+	enc, err := n.encode()
+	if err != nil {
+		return false, err
+	}
+	b.block = *enc
+	return true, nil
+}
@@ -0,0 +1,232 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCountingStore counts the writes made to each block, and the blocks in use.
+type writeCountingStore struct {
+	domain.Store
+	writes  map[domain.Word]int
+	failAdd bool
+	// failAfter, where set, is the number of blocks that may be added before adding fails
+	failAfter int
+	live      int
+}
+
+func (s *writeCountingStore) AddBlock(b *domain.Block) (domain.Word, error) {
+	if s.failAdd {
+		return 0, errors.New("simulated failure")
+	}
+	if s.failAfter > 0 {
+		s.failAfter--
+		if s.failAfter == 0 {
+			s.failAdd = true
+		}
+	}
+	id, err := s.Store.AddBlock(b)
+	s.writes[id]++
+	s.live++
+	return id, err
+}
+
+func (s *writeCountingStore) FreeBlock(id domain.Word) error {
+	s.live--
+	return s.Store.FreeBlock(id)
+}
+
+func (s *writeCountingStore) WriteBlock(id domain.Word, b *domain.Block) (domain.Word, error) {
+	id, err := s.Store.WriteBlock(id, b)
+	s.writes[id]++
+	return id, err
+}
+
+func TestApply(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		store domain.Store
+		opts  []Option
+	}{
+		{"InPlace", mem.New(), nil},
+		{"CopyOnWrite", mem.New(), []Option{CopyOnWrite()}},
+		{"Counted", mem.New(), []Option{Counted(), CompressKeys()}},
+		{"NewBlocks", &appendingMemStore{}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			store := &writeCountingStore{Store: test.store, writes: map[domain.Word]int{}}
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(3, 2, store, 0, start, test.opts...)
+			expected := map[[2]domain.Word]domain.Word{}
+
+			for round := 0; round < 10; round++ {
+				var b Batch
+				for i := 0; i < 500; i++ {
+					k := [2]domain.Word{domain.Word(rng.Intn(20) + 1), domain.Word(rng.Intn(50))}
+					if rng.Intn(3) == 0 {
+						b.Delete(k[:])
+						delete(expected, k)
+					} else {
+						v := domain.Word(rng.Intn(1000))
+						b.Put([]domain.Word{k[0], k[1], v})
+						expected[k] = v
+					}
+				}
+
+				store.writes = map[domain.Word]int{}
+				require.Nil(t, tree.Apply(&b))
+				for id, c := range store.writes {
+					assert.Equal(t, 1, c, "block %d", id)
+				}
+
+				assertSound(t, tree)
+				c, err := tree.Count(Bound{}, Bound{})
+				require.Nil(t, err)
+				assert.Equal(t, len(expected)+1, c)
+				for k, v := range expected {
+					assert.Equal(t, v, getRow(t, tree, k[:])[2])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLastWins(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start)
+	require.Nil(t, tree.Put([]domain.Word{1, 1}))
+
+	var b Batch
+	b.Put([]domain.Word{2, 1})
+	b.Delete([]domain.Word{1})
+	b.Put([]domain.Word{1, 2})
+	b.Delete([]domain.Word{2})
+	b.Delete([]domain.Word{3})
+	require.Nil(t, tree.Apply(&b))
+
+	assert.Equal(t, []domain.Word{1, 2}, getRow(t, tree, key(1)))
+	_, err := tree.Get(key(2))
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestApplyFailure(t *testing.T) {
+	store := &writeCountingStore{Store: mem.New(), writes: map[domain.Word]int{}}
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(20, 1, store, 0, start, Overflow())
+	for i := 1; i <= 100; i++ {
+		require.Nil(t, tree.Put(wideRow(domain.Word(i), 20)))
+	}
+	root, depth := tree.Root(), tree.Depth()
+
+	var b Batch
+	for i := 1; i <= 100; i++ {
+		b.Delete(key(domain.Word(i)))
+	}
+	b.Put(wideRow(200, 20))
+
+	// the wide row needs a block of its own
+	store.failAdd = true
+	assert.NotNil(t, tree.Apply(&b))
+	store.failAdd = false
+
+	assert.Equal(t, root, tree.Root())
+	assert.Equal(t, depth, tree.Depth())
+	assertSound(t, tree)
+	for i := 1; i <= 100; i++ {
+		assert.Equal(t, wideRow(domain.Word(i), 20), getRow(t, tree, key(domain.Word(i))))
+	}
+
+	var bad Batch
+	bad.Put([]domain.Word{1})
+	assert.True(t, errors.Is(tree.Apply(&bad), ErrBadRow))
+}
+
+func TestApplyFlushFailure(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		columns int
+		opts    []Option
+	}{
+		{"Narrow", 2, nil},
+		{"Overflow", 20, []Option{Overflow()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := &writeCountingStore{Store: mem.New(), writes: map[domain.Word]int{}}
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(test.columns, 1, store, 0, start, test.opts...)
+			for i := 1; i <= 1000; i++ {
+				require.Nil(t, tree.Put(wideRow(domain.Word(i), test.columns)))
+			}
+			root, depth, live := tree.Root(), tree.Depth(), store.live
+
+			var b Batch
+			for i := 1; i <= 1000; i += 3 {
+				b.Delete(key(domain.Word(i)))
+				b.Put(wideRow(domain.Word(i+2000), test.columns))
+			}
+
+			// the batch is all staged before the first block is added
+			store.failAfter = 5
+			assert.NotNil(t, tree.Apply(&b))
+			store.failAdd = false
+
+			assert.Equal(t, root, tree.Root())
+			assert.Equal(t, depth, tree.Depth())
+			assert.Equal(t, live, store.live)
+			assertSound(t, tree)
+			for i := 1; i <= 1000; i++ {
+				assert.Equal(t, wideRow(domain.Word(i), test.columns), getRow(t, tree, key(domain.Word(i))))
+			}
+
+			// the batch goes through once the store recovers
+			require.Nil(t, tree.Apply(&b))
+			assertSound(t, tree)
+			_, err := tree.Get(key(1))
+			assert.True(t, errors.Is(err, ErrNotFound))
+			assert.Equal(t, wideRow(2001, test.columns), getRow(t, tree, key(2001)))
+		})
+	}
+}
+
+func TestApplyLeafOnce(t *testing.T) {
+	store := &readCountingStore{Store: mem.New()}
+	tree, err := Load(2, 1, store, countingRows(1, 5000), 0.7)
+	require.Nil(t, err)
+	require.Equal(t, 2, tree.Depth())
+
+	var b Batch
+	for i := 1000; i < 2000; i++ {
+		b.Put([]domain.Word{domain.Word(i), 0})
+	}
+	for i := 2000; i < 2200; i++ {
+		b.Delete(key(domain.Word(i)))
+	}
+
+	// each leaf is found once, rather than once for each of its rows
+	store.reads = 0
+	require.Nil(t, tree.Apply(&b))
+	assert.Less(t, store.reads, 3*1200/10)
+	assertSound(t, tree)
+	assert.Equal(t, []domain.Word{1500, 0}, getRow(t, tree, key(1500)))
+	_, err = tree.Get(key(2100))
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestApplyStuck(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(20, 1, store, 0, start, Overflow())
+
+	// a chain block that refers to a staged block that is never written
+	tree.staging = &staging{blocks: map[domain.Word]*stagedBlock{}}
+	tree.staging.stageChain(&domain.Block{stagedID | 100})
+	assert.True(t, errors.Is(tree.flush(), ErrBadNode))
+}
@@ -0,0 +1,122 @@
+package tree
+
+import "github.com/catlev/pkg/domain"
+
+// A Collation orders the values of one column of a key. The built-in collations are kept in the
+// tree as words whose unsigned order is the order they give, so that the values are only changed
+// on the way in and out. A collation made by Ordered compares the values themselves instead.
+type Collation struct {
+	encode, decode func(domain.Word) domain.Word
+	compare        func(a, b domain.Word) int
+}
+
+var (
+	// Unsigned orders values as unsigned integers, as a tree does by default.
+	Unsigned = Collation{}
+	// Signed orders values as two's-complement signed integers.
+	Signed = Collation{encode: flipSign, decode: flipSign}
+	// Descending orders values as unsigned integers, largest first.
+	Descending = Collation{encode: invert, decode: invert}
+)
+
+// Ordered gives a collation that orders values with cmp, which returns a negative number when a
+// comes before b, a positive number when it comes after, and zero only when they are equal. The
+// lowest key of a tree is all zeros, so cmp must put zero before every other value.
+func Ordered(cmp func(a, b domain.Word) int) Collation {
+	return Collation{compare: cmp}
+}
+
+// Collate orders the key columns of the tree by the given collations, one per column from the
+// first. Columns without a collation are unsigned. A tree always holds a row for its lowest key,
+// which under Signed is the most negative value and under Descending is the largest.
+func Collate(cs ...Collation) Option {
+	return func(t *Tree) {
+		t.collations = make([]Collation, t.key)
+		copy(t.collations, cs)
+		for _, c := range t.collations {
+			if c.encode != nil {
+				t.coded = true
+			}
+			if c.compare != nil {
+				t.order = t.collations
+			}
+		}
+	}
+}
+
+func flipSign(w domain.Word) domain.Word {
+	return w ^ 1<<63
+}
+
+func invert(w domain.Word) domain.Word {
+	return ^w
+}
+
+// An order compares keys column by column, each under its own collation. A nil order compares every
+// column as unsigned.
+type order []Collation
+
+// compare is compareValues under the order.
+func (o order) compare(a, b []domain.Word) int {
+	if o == nil {
+		return compareValues(a, b)
+	}
+	for i := 0; i < min(len(a), len(b)); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		cmp := o[i].compare
+		switch {
+		case cmp == nil && b[i] > a[i], cmp != nil && cmp(a[i], b[i]) < 0:
+			return 1
+		default:
+			return -1
+		}
+	}
+	return compareValues(a[min(len(a), len(b)):], b[min(len(a), len(b)):])
+}
+
+// encodeKey gives key, or a prefix of it, in the form kept in the tree.
+func (t *Tree) encodeKey(key []domain.Word) []domain.Word {
+	if !t.coded || key == nil {
+		return key
+	}
+	return t.convert(key, min(len(key), t.key), func(c Collation) func(domain.Word) domain.Word {
+		return c.encode
+	})
+}
+
+// encodeRow gives row in the form kept in the tree.
+func (t *Tree) encodeRow(row []domain.Word) []domain.Word {
+	if !t.coded {
+		return row
+	}
+	return t.convert(row, min(len(row), t.key), func(c Collation) func(domain.Word) domain.Word {
+		return c.encode
+	})
+}
+
+// decodeRow gives a row, or a key, kept in the tree in the form it was put in.
+func (t *Tree) decodeRow(row []domain.Word) []domain.Word {
+	if !t.coded || row == nil {
+		return row
+	}
+	return t.convert(row, min(len(row), t.key), func(c Collation) func(domain.Word) domain.Word {
+		return c.decode
+	})
+}
+
+func (t *Tree) convert(row []domain.Word, key int, fn func(Collation) func(domain.Word) domain.Word) []domain.Word {
+	out := append([]domain.Word(nil), row...)
+	for i := 0; i < key; i++ {
+		if f := fn(t.collations[i]); f != nil {
+			out[i] = f(out[i])
+		}
+	}
+	return out
+}
+
+func (t *Tree) encodeBound(b Bound) Bound {
+	b.Key = t.encodeKey(b.Key)
+	return b
+}
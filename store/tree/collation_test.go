@@ -0,0 +1,166 @@
+package tree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signed(v int64) domain.Word {
+	return domain.Word(v)
+}
+
+func collectKeys(t *testing.T, r *Range, dir int, column int) []domain.Word {
+	var keys []domain.Word
+	move := r.Next
+	if dir < 0 {
+		move = r.Prev
+	}
+	for move() {
+		keys = append(keys, r.This()[column])
+	}
+	require.Nil(t, r.Err())
+	return keys
+}
+
+func TestCollateSigned(t *testing.T) {
+	for _, opts := range [][]Option{
+		{Collate(Signed)},
+		{Collate(Signed), CompressKeys(), Counted()},
+	} {
+		tree := newTestTree(2, 1, opts...)
+
+		var want []domain.Word
+		for _, i := range rand.New(rand.NewSource(1)).Perm(1001) {
+			k := signed(int64(i) - 500)
+			require.Nil(t, tree.Put([]domain.Word{k, k * 2}))
+		}
+		for i := int64(-500); i <= 500; i++ {
+			want = append(want, signed(i))
+		}
+		assertSound(t, tree)
+
+		// the row for the lowest key comes first
+		assert.Equal(t, []domain.Word{signed(math.MinInt64), 0}, getRow(t, tree, []domain.Word{signed(math.MinInt64)}))
+		assert.Equal(t, []domain.Word{signed(-3), signed(-6)}, getRow(t, tree, []domain.Word{signed(-3)}))
+
+		r := tree.GetRange(Inclusive([]domain.Word{signed(-500)}), Bound{})
+		assert.Equal(t, want, collectKeys(t, r, 1, 0))
+
+		r = tree.GetRange(Exclusive([]domain.Word{signed(-3)}), Inclusive([]domain.Word{signed(2)}))
+		assert.Equal(t, []domain.Word{signed(2), signed(1), 0, signed(-1), signed(-2)}, collectKeys(t, r, -1, 0))
+
+		c, err := tree.Count(Inclusive([]domain.Word{signed(-10)}), Exclusive([]domain.Word{signed(10)}))
+		require.Nil(t, err)
+		assert.Equal(t, 20, c)
+
+		c, err = tree.Rank([]domain.Word{signed(-500)})
+		require.Nil(t, err)
+		assert.Equal(t, 1, c)
+
+		row, err := tree.Select(1)
+		require.Nil(t, err)
+		assert.Equal(t, []domain.Word{signed(-500), signed(-1000)}, row)
+
+		for i := int64(-500); i < 0; i++ {
+			require.Nil(t, tree.Delete([]domain.Word{signed(i)}))
+		}
+		assertSound(t, tree)
+		r = tree.GetRange(Bound{}, Inclusive([]domain.Word{signed(1)}))
+		assert.Equal(t, []domain.Word{signed(math.MinInt64), 0, 1}, collectKeys(t, r, 1, 0))
+	}
+}
+
+func TestCollateDescending(t *testing.T) {
+	tree := newTestTree(3, 2, Collate(Unsigned, Descending))
+
+	var b Batch
+	for a := domain.Word(1); a <= 20; a++ {
+		for c := domain.Word(1); c <= 20; c++ {
+			b.Put([]domain.Word{a, c, a*100 + c})
+		}
+	}
+	require.Nil(t, tree.Apply(&b))
+	assertSound(t, tree)
+
+	var want []domain.Word
+	for c := domain.Word(20); c >= 1; c-- {
+		want = append(want, c)
+	}
+	assert.Equal(t, want, collectKeys(t, tree.Scan([]domain.Word{7}), 1, 1))
+
+	r := tree.GetRange(Inclusive([]domain.Word{3, 5}), Exclusive([]domain.Word{4, 18}))
+	assert.Equal(t, []domain.Word{305, 304, 303, 302, 301, 420, 419}, collectKeys(t, r, 1, 2))
+
+	r = tree.GetRange(Bound{}, Bound{})
+	assert.True(t, r.Seek([]domain.Word{9, 3}))
+	assert.Equal(t, []domain.Word{9, 3, 903}, r.This())
+	assert.True(t, r.Next())
+	assert.Equal(t, []domain.Word{9, 2, 902}, r.This())
+
+	require.Nil(t, tree.Update([]domain.Word{9, 3}, func(row []domain.Word) ([]domain.Word, bool) {
+		assert.Equal(t, []domain.Word{9, 3, 903}, row)
+		return []domain.Word{9, 3, 7}, true
+	}))
+	assert.Equal(t, []domain.Word{9, 3, 7}, getRow(t, tree, []domain.Word{9, 3}))
+}
+
+func TestCollateOrdered(t *testing.T) {
+	// by last digit, then by value, which keeps zero first
+	byDigit := Ordered(func(a, b domain.Word) int {
+		switch {
+		case a%10 != b%10:
+			return int(a%10) - int(b%10)
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	})
+
+	var rows [][]domain.Word
+	for d := domain.Word(0); d < 10; d++ {
+		for k := d; k < 1000; k += 10 {
+			if k != 0 {
+				rows = append(rows, []domain.Word{k, 1, k})
+				rows = append(rows, []domain.Word{k, 2, k})
+			}
+		}
+	}
+
+	for _, opts := range [][]Option{
+		{Collate(byDigit)},
+		{Collate(byDigit), CompressKeys()},
+	} {
+		loaded, err := Load(3, 2, mem.New(), newSliceRows(rows...), 0.75, opts...)
+		require.Nil(t, err)
+		assertSound(t, loaded)
+
+		tree := newTestTree(3, 2, opts...)
+		for _, i := range rand.New(rand.NewSource(2)).Perm(len(rows)) {
+			require.Nil(t, tree.Put(rows[i]))
+		}
+		assertSound(t, tree)
+
+		for _, tr := range []*Tree{loaded, tree} {
+			keys := collectKeys(t, tr.GetRange(Exclusive([]domain.Word{0, 0}), Bound{}), 1, 0)
+			require.Len(t, keys, len(rows))
+			for i := range keys {
+				assert.Equal(t, rows[i][0], keys[i])
+			}
+
+			assert.Equal(t, []domain.Word{2, 2, 2}, getRow(t, tr, []domain.Word{2, 2}))
+			assert.Equal(t, []domain.Word{7, 7}, collectKeys(t, tr.Scan([]domain.Word{7}), -1, 0))
+			assert.Equal(t, []domain.Word{12, 12}, collectKeys(t, tr.Scan([]domain.Word{12}), 1, 0))
+		}
+
+		_, err = Load(3, 2, mem.New(), newSliceRows([]domain.Word{3, 1, 0}, []domain.Word{11, 1, 0}), 1, opts...)
+		assert.ErrorIs(t, err, ErrUnsorted)
+	}
+}
@@ -0,0 +1,140 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressFanOut(t *testing.T) {
+	// rows keyed by (parent, child), as in a table of children grouped by their parent
+	build := func(opts ...Option) (*Tree, *countingStore) {
+		store := &countingStore{Store: *mem.New()}
+		start, _ := store.AddBlock(&domain.Block{})
+		tree := New(3, 2, store, 0, start, opts...)
+		for i := 1; i <= 300; i++ {
+			require.Nil(t, tree.Put([]domain.Word{7, domain.Word(i), domain.Word(i)}))
+		}
+		return tree, store
+	}
+
+	plain, plainStore := build()
+	compressed, compressedStore := build(CompressKeys())
+	assertSound(t, compressed)
+
+	// each leaf row takes two words instead of three
+	assert.Less(t, compressedStore.live, plainStore.live*3/4)
+	for i := 1; i <= 300; i++ {
+		key := []domain.Word{7, domain.Word(i)}
+		assert.Equal(t, getRow(t, plain, key), getRow(t, compressed, key))
+	}
+}
+
+func TestCompressRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(4, 3, store, 0, start, CompressKeys())
+	expected := map[[3]domain.Word]domain.Word{}
+
+	for i := 1; i <= 8000; i++ {
+		// few distinct leading words, so that the shared prefix of a node comes and goes
+		k := [3]domain.Word{
+			domain.Word(rng.Intn(2) + 1),
+			domain.Word(rng.Intn(3)),
+			domain.Word(rng.Intn(200)),
+		}
+		if rng.Intn(3) == 0 {
+			err := tree.Delete(k[:])
+			_, ok := expected[k]
+			assert.Equal(t, !ok, errors.Is(err, ErrNotFound))
+			delete(expected, k)
+		} else {
+			v := domain.Word(rng.Intn(1000))
+			require.Nil(t, tree.Put([]domain.Word{k[0], k[1], k[2], v}))
+			expected[k] = v
+		}
+
+		if i%500 != 0 {
+			continue
+		}
+		assertSound(t, tree)
+		for k, v := range expected {
+			assert.Equal(t, v, getRow(t, tree, k[:])[3])
+		}
+	}
+}
+
+func TestLoadCompressed(t *testing.T) {
+	var rows [][]domain.Word
+	for i := 1; i <= 1000; i++ {
+		rows = append(rows, []domain.Word{domain.Word(i / 100), domain.Word(i), domain.Word(i)})
+	}
+
+	for _, fill := range []float64{0.5, 1} {
+		tree, err := Load(3, 2, mem.New(), newSliceRows(rows...), fill, CompressKeys())
+		require.Nil(t, err)
+		assertSound(t, tree)
+
+		r := tree.GetRange(Inclusive([]domain.Word{0, 1}), Bound{})
+		for _, row := range rows {
+			require.True(t, r.Next())
+			assert.Equal(t, row, r.This())
+		}
+		assert.False(t, r.Next())
+		assert.Nil(t, r.Err())
+	}
+}
+
+func TestCompressBadNode(t *testing.T) {
+	store := mem.New()
+	// claims a prefix longer than the key
+	id, _ := store.AddBlock(&domain.Block{2 | 3<<32})
+	tree := New(3, 2, store, 0, id, CompressKeys())
+
+	_, err := tree.Get([]domain.Word{0, 0})
+	assert.ErrorIs(t, err, ErrBadNode)
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(3, 2, store, 0, start, CompressKeys())
+	expected := map[[2]domain.Word]domain.Word{}
+
+	// keys spread over the whole range share no prefix, so each node pays for its header word
+	for i := 1; i <= 3000; i++ {
+		k := [2]domain.Word{domain.Word(rng.Uint64()), domain.Word(rng.Uint64())}
+		require.Nil(t, tree.Put([]domain.Word{k[0], k[1], domain.Word(i)}))
+		expected[k] = domain.Word(i)
+	}
+
+	assertSound(t, tree)
+	for k, v := range expected {
+		assert.Equal(t, []domain.Word{k[0], k[1], v}, getRow(t, tree, k[:]))
+	}
+}
+
+func TestCompressNodeFull(t *testing.T) {
+	n := New(5, 4, mem.New(), 0, 0, CompressKeys()).newNode(true)
+	for i := 0; i < 31; i++ {
+		n.insert(i, []domain.Word{domain.Word(i + 1), 2, 3, 4, 5})
+	}
+
+	// no more than 12 rows without a common prefix fit in a block, so no split leaves both halves
+	// fitting
+	_, err := n.encode()
+	assert.True(t, errors.Is(err, ErrNodeFull))
+	_, err = n.splitPoint()
+	assert.True(t, errors.Is(err, ErrNodeFull))
+
+	n.remove(12, 19)
+	_, err = n.encode()
+	assert.Nil(t, err)
+}
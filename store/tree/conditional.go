@@ -0,0 +1,104 @@
+package tree
+
+import "github.com/catlev/pkg/domain"
+
+// PutIfAbsent adds row to the tree, unless there is already a row with its key, in which case
+// ErrExists is returned. Errors may also originate from the block store.
+func (t *Tree) PutIfAbsent(row []domain.Word) (err error) {
+	if len(row) != t.columns {
+		return &TreeError{
+			Err: ErrBadRow,
+			Op:  "PutIfAbsent",
+		}
+	}
+
+	return t.modify("PutIfAbsent", row[:t.key], func(current []domain.Word) ([]domain.Word, error) {
+		if current != nil {
+			return nil, ErrExists
+		}
+		return row, nil
+	})
+}
+
+// CompareAndSwap replaces old with new, provided that old is the row in the tree now. The two rows
+// must have the same key. If there is no row with the key, ErrNotFound is returned, and if there is
+// one that differs from old, ErrMismatch is returned. Errors may also originate from the block
+// store.
+func (t *Tree) CompareAndSwap(old, new []domain.Word) (err error) {
+	if len(old) != t.columns || len(new) != t.columns || compareValues(old[:t.key], new[:t.key]) != 0 {
+		return &TreeError{
+			Err: ErrBadRow,
+			Op:  "CompareAndSwap",
+		}
+	}
+
+	return t.modify("CompareAndSwap", old[:t.key], func(current []domain.Word) ([]domain.Word, error) {
+		switch {
+		case current == nil:
+			return nil, ErrNotFound
+		case compareValues(current, old) != 0:
+			return nil, ErrMismatch
+		}
+		return new, nil
+	})
+}
+
+// Update hands the row with the given key to fn, or nil if there is none, and replaces it with the
+// row that fn gives back. A nil row removes the key from the tree. If fn gives back false, the tree
+// is left alone and ErrAborted is returned. The row given back must have the same key, or else
+// ErrBadRow is returned. fn is called while the tree is locked for writing, so it must not use the
+// tree itself. Errors may also originate from the block store.
+func (t *Tree) Update(key []domain.Word, fn func(row []domain.Word) ([]domain.Word, bool)) (err error) {
+	return t.modify("Update", key, func(current []domain.Word) ([]domain.Word, error) {
+		row, ok := fn(current)
+		if !ok {
+			return nil, ErrAborted
+		}
+		return row, nil
+	})
+}
+
+// modify finds the row for key and hands it to change, or nil if there is none, with a single
+// descent of the tree. change gives back the row to replace it with, or nil to remove it.
+func (t *Tree) modify(op string, key []domain.Word, change func([]domain.Word) ([]domain.Word, error)) (err error) {
+	defer wrapErr(&err, op, key)
+
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(key) != t.key {
+		return ErrKeyWidth
+	}
+
+	t.beginWrite()
+	defer t.endWrite(&err)
+
+	n, idx, found, err := t.locate(t.encodeKey(key))
+	if err != nil {
+		return err
+	}
+
+	var current []domain.Word
+	if found {
+		current, err = t.loadRow(n.getRow(idx))
+		if err != nil {
+			return err
+		}
+		current = append([]domain.Word(nil), t.decodeRow(current)...)
+	}
+
+	row, err := change(current)
+	switch {
+	case err != nil:
+		return err
+	case row == nil && found:
+		return t.deleteAt(n, idx)
+	case row == nil:
+		return nil
+	case len(row) != t.columns || compareValues(row[:t.key], key) != 0:
+		return ErrBadRow
+	}
+
+	return t.putAt(n, idx, found, t.encodeRow(row))
+}
@@ -0,0 +1,121 @@
+package tree
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTree(columns, key int, opts ...Option) *Tree {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	return New(columns, key, store, 0, start, opts...)
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	tree := newTestTree(2, 1)
+
+	require.Nil(t, tree.PutIfAbsent([]domain.Word{1, 10}))
+	err := tree.PutIfAbsent([]domain.Word{1, 20})
+	assert.True(t, errors.Is(err, ErrExists))
+	assert.Equal(t, []domain.Word{1, 10}, getRow(t, tree, key(1)))
+
+	err = tree.PutIfAbsent([]domain.Word{1})
+	assert.True(t, errors.Is(err, ErrBadRow))
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := newTestTree(20, 1, Overflow())
+	row := wideRow(1, 20)
+
+	err := tree.CompareAndSwap(row, row)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	require.Nil(t, tree.Put(row))
+	next := wideRow(1, 20)
+	next[19] = 0
+	require.Nil(t, tree.CompareAndSwap(row, next))
+	assert.Equal(t, next, getRow(t, tree, key(1)))
+
+	err = tree.CompareAndSwap(row, next)
+	assert.True(t, errors.Is(err, ErrMismatch))
+
+	err = tree.CompareAndSwap(next, wideRow(2, 20))
+	assert.True(t, errors.Is(err, ErrBadRow))
+}
+
+func TestUpdate(t *testing.T) {
+	tree := newTestTree(2, 1)
+
+	increment := func(row []domain.Word) ([]domain.Word, bool) {
+		if row == nil {
+			return []domain.Word{1, 1}, true
+		}
+		row[1]++
+		return row, true
+	}
+	for i := 0; i < 3; i++ {
+		require.Nil(t, tree.Update(key(1), increment))
+	}
+	assert.Equal(t, []domain.Word{1, 3}, getRow(t, tree, key(1)))
+
+	err := tree.Update(key(1), func(row []domain.Word) ([]domain.Word, bool) {
+		row[1] = 100
+		return row, false
+	})
+	assert.True(t, errors.Is(err, ErrAborted))
+	assert.Equal(t, []domain.Word{1, 3}, getRow(t, tree, key(1)))
+
+	err = tree.Update(key(1), func(row []domain.Word) ([]domain.Word, bool) {
+		return []domain.Word{2, 1}, true
+	})
+	assert.True(t, errors.Is(err, ErrBadRow))
+
+	require.Nil(t, tree.Update(key(1), func(row []domain.Word) ([]domain.Word, bool) {
+		return nil, true
+	}))
+	_, err = tree.Get(key(1))
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// removing a row that isn't there does nothing
+	require.Nil(t, tree.Update(key(1), func(row []domain.Word) ([]domain.Word, bool) {
+		return nil, true
+	}))
+}
+
+func TestConditionalConcurrent(t *testing.T) {
+	tree := newTestTree(2, 1, CopyOnWrite())
+
+	// every goroutine tries to claim every id, and each id should go to just one of them
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := map[domain.Word]int{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for id := domain.Word(1); id <= 200; id++ {
+				err := tree.PutIfAbsent([]domain.Word{id, domain.Word(g)})
+				if errors.Is(err, ErrExists) {
+					continue
+				}
+				assert.Nil(t, err)
+				mu.Lock()
+				claimed[id]++
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Len(t, claimed, 200)
+	for _, c := range claimed {
+		assert.Equal(t, 1, c)
+	}
+	assertSound(t, tree)
+}
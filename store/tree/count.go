@@ -0,0 +1,140 @@
+package tree
+
+import "github.com/catlev/pkg/domain"
+
+// Count gives the number of entries with keys between from and to. Without Counted, the entries
+// are counted one by one. Errors may originate from the block store.
+func (t *Tree) Count(from, to Bound) (c int, err error) {
+	defer wrapErr(&err, "Count", from.Key)
+
+	return t.count(from, to)
+}
+
+// Rank gives the number of entries with keys less than the given key, which is the position of the
+// entry for the key in the tree, or where it would go if there were one. Without Counted, the
+// entries are counted one by one. Errors may originate from the block store.
+func (t *Tree) Rank(key []domain.Word) (c int, err error) {
+	defer wrapErr(&err, "Rank", key)
+
+	return t.count(Bound{}, Exclusive(key))
+}
+
+func (t *Tree) count(from, to Bound) (int, error) {
+	if len(from.Key) > t.key || len(to.Key) > t.key {
+		return 0, ErrKeyWidth
+	}
+
+	if !t.counted {
+		c := 0
+		r := t.GetRange(from, to)
+		for r.Next() {
+			c++
+		}
+		return c, r.err
+	}
+
+	from, to = t.encodeBound(from), t.encodeBound(to)
+
+	cur := t.beginRead()
+	defer t.endRead()
+
+	hi, err := t.countBelow(cur, to.Key, !to.Exclusive)
+	if err != nil {
+		return 0, err
+	}
+	if from.Key == nil {
+		return hi, nil
+	}
+	lo, err := t.countBelow(cur, from.Key, from.Exclusive)
+	if err != nil {
+		return 0, err
+	}
+	return max(hi-lo, 0), nil
+}
+
+// Select gives the entry at the given position in the tree, counting from zero. If there is no such
+// entry, ErrNotFound is returned. Without Counted, the range is stepped through entry by entry.
+// Errors may also originate from the block store.
+func (t *Tree) Select(i int) (row []domain.Word, err error) {
+	defer wrapErr(&err, "Select", nil)
+
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	if !t.counted {
+		r := t.GetRange(Bound{}, Bound{})
+		for r.Next() {
+			if i == 0 {
+				return r.This(), nil
+			}
+			i--
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, ErrNotFound
+	}
+
+	cur := t.beginRead()
+	defer t.endRead()
+
+	rest := domain.Word(i)
+	n, err := t.findLeaf(cur, func(n *node) int {
+		for j := 0; j < n.width-1; j++ {
+			c := n.getRow(j)[n.key+1]
+			if rest < c {
+				return j
+			}
+			rest -= c
+		}
+		return n.width - 1
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rest >= domain.Word(n.width) {
+		return nil, ErrNotFound
+	}
+
+	row, err = t.loadRow(n.getRow(int(rest)))
+	if err != nil {
+		return nil, err
+	}
+	return t.decodeRow(row), nil
+}
+
+// countBelow gives the number of entries with keys less than key, or no greater than key if
+// inclusive is set. A nil key lies beyond every entry.
+func (t *Tree) countBelow(v *version, key []domain.Word, inclusive bool) (int, error) {
+	var c domain.Word
+
+	n, err := t.readNode(v.depth == 0, nil, 0, v.root)
+	if err != nil {
+		return 0, err
+	}
+
+	if key == nil {
+		return int(n.total()), nil
+	}
+
+	n, err = t.descend(n, v.depth, func(n *node) int {
+		idx := n.probe(key)
+		for j := 0; j < idx; j++ {
+			c += n.getRow(j)[n.key+1]
+		}
+		return idx
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n.width; i++ {
+		d := n.order.compare(n.getKey(i), key)
+		if d < 0 || d == 0 && !inclusive {
+			break
+		}
+		c++
+	}
+	return int(c), nil
+}
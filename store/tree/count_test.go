@@ -0,0 +1,116 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertOrderStatistics checks Count, Rank and Select against the sorted keys the tree should hold.
+func assertOrderStatistics(t *testing.T, tree *Tree, keys []domain.Word) {
+	t.Helper()
+
+	c, err := tree.Count(Bound{}, Bound{})
+	require.Nil(t, err)
+	assert.Equal(t, len(keys), c)
+
+	for i, k := range keys {
+		row, err := tree.Select(i)
+		require.Nil(t, err)
+		assert.Equal(t, k, row[0])
+
+		rank, err := tree.Rank(key(k))
+		require.Nil(t, err)
+		assert.Equal(t, i, rank)
+	}
+	_, err = tree.Select(len(keys))
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	for i := 0; i < 20; i++ {
+		from, to := domain.Word(rand.Intn(1100)), domain.Word(rand.Intn(1100))
+		expected := sort.Search(len(keys), func(i int) bool { return keys[i] > to }) -
+			sort.Search(len(keys), func(i int) bool { return keys[i] > from })
+		c, err := tree.Count(Exclusive(key(from)), Inclusive(key(to)))
+		require.Nil(t, err)
+		assert.Equal(t, max(expected, 0), c)
+	}
+}
+
+func TestCountedRandom(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Counted", []Option{Counted()}},
+		{"CopyOnWrite", []Option{Counted(), CopyOnWrite()}},
+		{"CompressKeys", []Option{Counted(), CompressKeys()}},
+		{"Uncounted", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			store := mem.New()
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(2, 1, store, 0, start, test.opts...)
+			expected := map[domain.Word]bool{0: true}
+
+			for i := 1; i <= 4000; i++ {
+				k := domain.Word(rng.Intn(1000) + 1)
+				if rng.Intn(3) == 0 {
+					tree.Delete(key(k))
+					delete(expected, k)
+				} else {
+					require.Nil(t, tree.Put([]domain.Word{k, k}))
+					expected[k] = true
+				}
+
+				if i%1000 != 0 {
+					continue
+				}
+				assertSound(t, tree)
+
+				var keys []domain.Word
+				for k := range expected {
+					keys = append(keys, k)
+				}
+				sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+				assertOrderStatistics(t, tree, keys)
+			}
+		})
+	}
+}
+
+func TestLoadCounted(t *testing.T) {
+	keys := make([]domain.Word, 3000)
+	rows := make([][]domain.Word, 3000)
+	for i := range rows {
+		keys[i] = domain.Word(i)
+		rows[i] = []domain.Word{domain.Word(i), 1}
+	}
+
+	tree, err := Load(2, 1, mem.New(), newSliceRows(rows...), 0.7, Counted())
+	require.Nil(t, err)
+	assertSound(t, tree)
+	assertOrderStatistics(t, tree, keys)
+}
+
+func TestVerifyCount(t *testing.T) {
+	store := mem.New()
+	var b1, b2 domain.Block
+	// two rows of 16 columns each
+	b1[16] = 1
+	b2[0], b2[16] = 2, 3
+	leaf1, _ := store.AddBlock(&b1)
+	leaf2, _ := store.AddBlock(&b2)
+	root, _ := store.AddBlock(&domain.Block{0, leaf1, 2, 2, leaf2, 3})
+	tree := New(16, 1, store, 1, root, Counted())
+
+	problems, err := Verify(tree)
+	require.Nil(t, err)
+	assert.Equal(t, []Problem{{Kind: BadCount, Block: root, Level: 1, Row: 1}}, problems)
+}
@@ -2,39 +2,149 @@ package tree
 
 import (
 	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/catlev/pkg/domain"
 )
 
-// Maps keys to values, based on a block store.
+// Maps keys to values, based on a block store. A tree may be read by many goroutines at once,
+// alongside one writing to it, provided that its block store is safe for concurrent use.
 type Tree struct {
-	columns int
-	key     int
-	store   domain.Store
-	root    domain.Word
-	depth   int
+	columns    int
+	key        int
+	store      domain.Store
+	root       domain.Word
+	depth      int
+	overflow   bool
+	compress   bool
+	counted    bool
+	cow        bool
+	readOnly   bool
+	collations []Collation
+	coded      bool
+	order      order
+	onRoot     func(root domain.Word, depth int) error
+	fresh      map[domain.Word]bool
+	changed    bool
+	latched    bool
+	staging    *staging
+	writer     sync.Mutex
+	latch      sync.RWMutex
+	current    atomic.Pointer[version]
 }
 
+// An Option configures a tree when it is created.
+type Option func(*Tree)
+
+// CopyOnWrite makes every mutation of the tree write new blocks rather than overwriting the ones
+// already in the store, so that each mutation produces a new root. Blocks allocated since the last
+// call to Snapshot, or the last time a range started, are private to the writer, and so may still
+// be updated in place.
+func CopyOnWrite() Option {
+	return func(t *Tree) {
+		t.cow = true
+	}
+}
+
+// CompressKeys stores each node with the leading key words that its rows have in common written
+// only once, so that nodes whose keys share a prefix hold more rows.
+func CompressKeys() Option {
+	return func(t *Tree) {
+		t.compress = true
+	}
+}
+
+// Counted keeps a count of the rows under each child of an interior node, so that Count, Rank and
+// Select need only descend the tree. The counts have to be kept up to date, so every mutation
+// writes the whole path from the root to the leaves it changes.
+func Counted() Option {
+	return func(t *Tree) {
+		t.counted = true
+	}
+}
+
+// Overflow keeps the non-key columns of each row in a chain of blocks of its own, leaving only the
+// key and the id of the chain in the leaves, so that rows too wide to fit a leaf several times
+// over can be kept. The leaves of a tree are laid out differently with overflow chains than without,
+// so a tree has to be opened with the option it was created with.
+func Overflow() Option {
+	return func(t *Tree) {
+		t.overflow = true
+	}
+}
+
+// OnRoot calls fn whenever a mutation leaves the tree with a new root or depth, before the mutation
+// returns, so that they can be kept somewhere. Should fn fail, the mutation returns its error, but
+// has nonetheless been made.
+func OnRoot(fn func(root domain.Word, depth int) error) Option {
+	return func(t *Tree) {
+		t.onRoot = fn
+	}
+}
+
+// A node holds its rows decoded, one after another, however its block encodes them.
 type node struct {
-	columns int
-	key     int
-	parent  *node
-	pos     int
-	id      domain.Word
-	width   int
-	entries domain.Block
+	columns  int
+	key      int
+	leaf     bool
+	compress bool
+	counted  bool
+	order    order
+	parent   *node
+	pos      int
+	id       domain.Word
+	width    int
+	entries  []domain.Word
 }
 
-func New(columns int, key int, store domain.Store, depth int, root domain.Word) *Tree {
-	return &Tree{columns, key, store, root, depth}
+func New(columns int, key int, store domain.Store, depth int, root domain.Word, opts ...Option) *Tree {
+	t := &Tree{
+		columns: columns,
+		key:     key,
+		store:   store,
+		root:    root,
+		depth:   depth,
+		fresh:   map[domain.Word]bool{},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.publish()
+	return t
 }
 
 func (t *Tree) Root() domain.Word {
-	return t.root
+	return t.current.Load().root
 }
 
 func (t *Tree) Depth() int {
-	return t.depth
+	return t.current.Load().depth
+}
+
+// Snapshot returns a read-only view of the tree as it is now. In copy-on-write mode the snapshot
+// is unaffected by later mutations of t, because none of the blocks reachable from its root are
+// written again. Superseded blocks are not freed, as a snapshot may still refer to them.
+func (t *Tree) Snapshot() *Tree {
+	v := t.pin()
+
+	s := &Tree{
+		columns:    t.columns,
+		key:        t.key,
+		store:      t.store,
+		root:       v.root,
+		depth:      v.depth,
+		overflow:   t.overflow,
+		compress:   t.compress,
+		counted:    t.counted,
+		cow:        t.cow,
+		readOnly:   true,
+		collations: t.collations,
+		coded:      t.coded,
+		order:      t.order,
+	}
+	s.publish()
+	return s
 }
 
 // intuition b - a
@@ -58,80 +168,176 @@ func compareValues(a, b []domain.Word) int {
 	}
 }
 
-func (t *Tree) findNode(key []domain.Word) (*node, error) {
-	if t.depth == 0 {
-		return t.readNode(t.columns, t.key, nil, 0, t.root)
-	}
+func (t *Tree) findNode(v *version, key []domain.Word) (*node, error) {
+	return t.findLeaf(v, func(n *node) int {
+		return n.probe(key)
+	})
+}
 
-	n, err := t.readNode(t.key+1, t.key, nil, 0, t.root)
+// findLeaf descends from the root of v to a leaf, using choose to pick the row to follow at each
+// level.
+func (t *Tree) findLeaf(v *version, choose func(*node) int) (*node, error) {
+	n, err := t.readNode(v.depth == 0, nil, 0, v.root)
 	if err != nil {
 		return nil, err
 	}
 
-	for d := t.depth - 1; d > 0; d-- {
-		n, err = t.followNode(t.key+1, t.key, n, n.probe(key))
+	return t.descend(n, v.depth, choose)
+}
+
+// descend continues a descent from n, which lies height levels above the leaves.
+func (t *Tree) descend(n *node, height int, choose func(*node) int) (*node, error) {
+	var err error
+
+	for ; height > 0; height-- {
+		n, err = t.followNode(height == 1, n, choose(n))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	step := n.probe(key)
-	return t.followNode(t.columns, t.key, n, step)
+	return n, nil
 }
 
-func (t *Tree) followNode(columns, key int, n *node, idx int) (*node, error) {
-	return t.readNode(columns, key, n, idx, n.getRow(idx)[key])
+func (t *Tree) followNode(leaf bool, n *node, idx int) (*node, error) {
+	return t.readNode(leaf, n, idx, n.getRow(idx)[t.key])
 }
 
-func (t *Tree) readNode(columns, key int, parent *node, pos int, id domain.Word) (*node, error) {
-	n := &node{
-		columns: columns,
-		key:     key,
-		parent:  parent,
-		pos:     pos,
-		id:      id,
-	}
+func (t *Tree) readNode(leaf bool, parent *node, pos int, id domain.Word) (*node, error) {
+	n := t.newNode(leaf)
+	n.parent = parent
+	n.pos = pos
+	n.id = id
 
-	err := t.store.ReadBlock(id, &n.entries)
+	var b domain.Block
+	err := t.readBlock(id, &b)
 	if err != nil {
 		return nil, err
 	}
 
-	n.width = sort.Search(n.maxWidth(), func(i int) bool {
-		if i == 0 {
-			return false
-		}
-		candidate := n.getKey(i)
-		for _, k := range candidate {
-			if k != 0 {
-				return false
-			}
-		}
-		return true
-	})
+	err = n.decode(&b)
+	if err != nil {
+		return nil, err
+	}
 
 	return n, nil
 }
 
+func (t *Tree) newNode(leaf bool) *node {
+	columns := t.key + 1
+	if leaf {
+		columns = t.leafColumns()
+	} else if t.counted {
+		columns++
+	}
+	return &node{
+		columns:  columns,
+		key:      t.key,
+		leaf:     leaf,
+		compress: t.compress,
+		counted:  t.counted && !leaf,
+		order:    t.order,
+	}
+}
+
 func (t *Tree) writeNode(n *node) error {
-	id, err := t.store.WriteBlock(n.id, n.entriesAsBlock())
+	t.changed = true
+
+	var id domain.Word
+	b, err := n.encode()
 	if err != nil {
 		return err
 	}
-	if id == n.id {
-		// the id of the node hasn't changed, so we don't need to update the parent
-		return nil
+	switch {
+	case t.staging != nil:
+		id = t.stage(n, b, false)
+	case t.cow && !t.fresh[n.id]:
+		// the block may be shared with a snapshot, so the node has to move
+		id, err = t.addBlock(b)
+	default:
+		id, err = t.store.WriteBlock(n.id, b)
+	}
+	if err != nil {
+		return err
 	}
 	if n.parent == nil {
 		// when the node's parent is nil, it's the root node
+		n.id = id
 		t.root = id
 		return nil
 	}
 
-	n.parent.getRow(n.pos)[t.key] = id
+	row := n.parent.getRow(n.pos)
+	if id == n.id && (!t.counted || row[t.key+1] == n.total()) {
+		// neither the id nor the count of the node has changed, so we don't need to update the parent
+		return nil
+	}
+	n.id = id
+	copy(row[t.key:], t.entry(nil, n)[t.key:])
 	return t.writeNode(n.parent)
 }
 
+// entry gives the row for a parent to refer to n by, under the given key.
+func (t *Tree) entry(key []domain.Word, n *node) []domain.Word {
+	row := make([]domain.Word, t.key+1, t.key+2)
+	copy(row, key)
+	row[t.key] = n.id
+	if t.counted {
+		row = append(row, domain.Word(n.total()))
+	}
+	return row
+}
+
+// addNode gives a new node its own block.
+func (t *Tree) addNode(n *node) error {
+	b, err := n.encode()
+	if err != nil {
+		return err
+	}
+	if t.staging != nil {
+		n.id = t.stage(n, b, true)
+		return nil
+	}
+
+	n.id, err = t.addBlock(b)
+	return err
+}
+
+func (t *Tree) readBlock(id domain.Word, b *domain.Block) error {
+	if id&stagedID != 0 {
+		*b = t.staging.blocks[id].block
+		return nil
+	}
+	return t.store.ReadBlock(id, b)
+}
+
+func (t *Tree) addBlock(b *domain.Block) (domain.Word, error) {
+	t.changed = true
+	id, err := t.store.AddBlock(b)
+	if err != nil {
+		return 0, err
+	}
+	if t.cow {
+		t.fresh[id] = true
+	}
+	return id, nil
+}
+
+func (t *Tree) freeBlock(id domain.Word) error {
+	if t.staging != nil {
+		// the tree as it was before the batch may still need the block
+		t.staging.free(id)
+		return nil
+	}
+	if t.cow && !t.fresh[id] {
+		// a snapshot may still refer to the block, so it has to stay where it is
+		return nil
+	}
+	t.changed = true
+	delete(t.fresh, id)
+	return t.store.FreeBlock(id)
+}
+
 func (t *Tree) writeNodes(ns ...*node) error {
 	for _, n := range ns {
 		err := t.writeNode(n)
@@ -145,30 +351,38 @@ func (t *Tree) writeNodes(ns ...*node) error {
 func (n *node) probe(key []domain.Word) int {
 	return sort.Search(n.width-1, func(i int) bool {
 		candidate := n.getKey(i + 1)
-		return compareValues(candidate, key) < 0
+		return n.order.compare(candidate, key) < 0
+	})
+}
+
+// probePrefix is probe for the last row whose key starts with prefix, or that any such key would
+// follow.
+func (n *node) probePrefix(prefix []domain.Word) int {
+	return sort.Search(n.width-1, func(i int) bool {
+		candidate := n.getKey(i + 1)[:len(prefix)]
+		return n.order.compare(candidate, prefix) < 0
 	})
 }
 
 func (n *node) insert(idx int, entries ...[]domain.Word) {
-	copy(n.entries[(idx+len(entries))*n.columns:], n.entries[idx*n.columns:])
+	at := idx * n.columns
+	n.entries = append(n.entries, make([]domain.Word, len(entries)*n.columns)...)
+	copy(n.entries[at+len(entries)*n.columns:], n.entries[at:])
+	n.width += len(entries)
 	for i, r := range entries {
-		copy(n.entries[(idx+i)*n.columns:], r)
+		copy(n.getRow(idx+i), r)
 	}
-	n.width += len(entries)
 }
 
 func (n *node) remove(idx, count int) {
 	n.width -= count
-	copy(n.entries[idx*n.columns:], n.entries[(idx+count)*n.columns:])
-	n.clearRows(n.width, -1)
-}
-
-func (n *node) entriesAsBlock() *domain.Block {
-	return &n.entries
+	n.entries = append(n.entries[:idx*n.columns], n.entries[(idx+count)*n.columns:]...)
 }
 
+// getKey gives the key of a row. Leaves hold the full key of every row, but the key of the first
+// row of an interior node is implied by the node's parent.
 func (n *node) getKey(idx int) []domain.Word {
-	if idx == 0 {
+	if idx == 0 && !n.leaf {
 		if n.parent == nil {
 			return make([]domain.Word, n.key)
 		}
@@ -194,20 +408,23 @@ func (n *node) getRows(from, to int) [][]domain.Word {
 	return rows
 }
 
-func (n *node) clearRows(from, to int) {
-	stop := to * n.columns
-	if to == -1 {
-		stop = domain.WordSize
+// total gives the number of rows under n.
+func (n *node) total() domain.Word {
+	if !n.counted {
+		return domain.Word(n.width)
 	}
-	for i := from * n.columns; i < stop; i++ {
-		n.entries[i] = 0
+	var total domain.Word
+	for i := 0; i < n.width; i++ {
+		total += n.getRow(i)[n.key+1]
 	}
+	return total
 }
 
 func (n *node) minWidth() int {
 	return n.maxWidth() / 2
 }
 
+// maxWidth gives the number of rows that fit in a block without compression.
 func (n *node) maxWidth() int {
 	return domain.WordSize / n.columns
 }
@@ -216,5 +433,5 @@ func (n *node) compareKeyAt(idx int, key []domain.Word) int {
 	if n == nil {
 		return 1
 	}
-	return compareValues(n.getKey(idx), key)
+	return n.order.compare(n.getKey(idx), key)
 }
@@ -7,65 +7,137 @@ import "github.com/catlev/pkg/domain"
 func (t *Tree) Delete(key []domain.Word) (err error) {
 	defer wrapErr(&err, "Delete", key)
 
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
 	if len(key) != t.key {
 		return ErrKeyWidth
 	}
 
-	n, err := t.findNode(key)
+	t.beginWrite()
+	defer t.endWrite(&err)
+
+	return t.delete(t.encodeKey(key))
+}
+
+func (t *Tree) delete(key []domain.Word) error {
+	n, idx, found, err := t.locate(key)
 	if err != nil {
 		return err
 	}
+	if !found {
+		return ErrNotFound
+	}
+	return t.deleteAt(n, idx)
+}
 
-	idx := n.probe(key)
-	if compareValues(n.getKey(idx), key) != 0 {
+// deleteAt removes the row at idx in the leaf n.
+func (t *Tree) deleteAt(n *node, idx int) error {
+	stored := append([]domain.Word(nil), n.getRow(idx)...)
+
+	err := t.deleteFromNode(n, idx)
+	if err != nil {
 		return err
 	}
 
-	return t.deleteFromNode(n, idx)
+	return t.freeRow(stored)
 }
 
 func (t *Tree) deleteFromNode(n *node, idx int) error {
 	n.remove(idx, 1)
+	return t.balanceTree(n)
+}
 
-	if n.width <= n.minWidth() {
-		if n.parent != nil {
-			return t.balanceTree(n)
-		}
-		if n.width == 2 {
+// balanceTree writes n after rows have been removed from it. If that leaves n below its minimum
+// width, it takes rows from a sibling or merges with one, which may in turn unbalance the parent.
+func (t *Tree) balanceTree(n *node) error {
+	if n.parent == nil {
+		if !n.leaf && n.width == 1 {
 			// superfluous root node
-			t.root = n.getRow((idx + 1) % 2)[t.key]
+			t.root = n.getRow(0)[t.key]
 			t.depth--
-			return t.store.FreeBlock(n.id)
+			return t.freeBlock(n.id)
 		}
+		return t.writeNode(n)
 	}
 
-	return t.writeNode(n)
-}
+	if n.width >= n.minWidth() || n.parent.width < 2 {
+		return t.writeNode(n)
+	}
 
-func (t *Tree) balanceTree(n *node) error {
-	pre, err := t.getPre(n)
+	left, right := n, n
+	var err error
+	if n.pos > 0 {
+		left, err = t.followNode(n.leaf, n.parent, n.pos-1)
+	} else {
+		right, err = t.followNode(n.leaf, n.parent, n.pos+1)
+	}
 	if err != nil {
 		return err
 	}
-	succ, err := t.getSucc(n)
+
+	// the first key of right is about to become explicit, whether it joins left or stays put
+	right.setkey(0, right.getKey(0))
+
+	if left.fitsWith(right) {
+		return t.mergeNodes(left, right)
+	}
+	return t.shareRows(left, right)
+}
+
+// mergeNodes moves all of the rows of right into its left sibling, and removes right from the
+// parent.
+func (t *Tree) mergeNodes(left, right *node) error {
+	left.insert(left.width, right.getRows(0, right.width)...)
+
+	err := t.writeNode(left)
 	if err != nil {
 		return err
 	}
 
-	if pre != nil && pre.width > pre.minWidth() {
-		return t.borrowPre(n, pre)
+	err = t.deleteFromNode(right.parent, right.pos)
+	if err != nil {
+		return err
 	}
-	if succ != nil && succ.width > succ.minWidth() {
-		return t.borrowSucc(n, succ)
+
+	return t.freeBlock(right.id)
+}
+
+// shareRows moves rows between two siblings so that each holds about half of them, and updates the
+// key that separates them in the parent.
+func (t *Tree) shareRows(left, right *node) error {
+	joined := left.clone()
+	joined.insert(joined.width, right.getRows(0, right.width)...)
+	half, err := joined.splitPoint()
+	if err != nil {
+		return err
 	}
-	if pre != nil && pre.width <= pre.minWidth() {
-		return t.mergePre(n, pre)
+
+	if left.width < half {
+		amt := half - left.width
+		left.insert(left.width, right.getRows(0, amt)...)
+		right.remove(0, amt)
+	} else {
+		amt := left.width - half
+		right.insert(0, left.getRows(half, left.width)...)
+		left.remove(half, amt)
 	}
-	if succ != nil && succ.width <= succ.minWidth() {
-		return t.mergeSucc(n, succ)
+
+	err = t.writeNodes(left, right)
+	if err != nil {
+		return err
 	}
 
-	panic("unreachable")
+	// with compressed keys the new separator may leave the parent short of room
+	parent := right.parent
+	separator := append([]domain.Word(nil), right.getRow(0)[:right.key]...)
+	parent.setkey(right.pos, separator)
+	if !parent.fits() {
+		_, err = t.splitNode(parent, separator)
+		return err
+	}
+	return t.writeNode(parent)
 }
 
 func (t *Tree) getPre(n *node) (*node, error) {
@@ -80,9 +152,9 @@ func (t *Tree) getPre(n *node) (*node, error) {
 		if pp == nil {
 			return nil, nil
 		}
-		return t.followNode(n.columns, n.key, pp, pp.width-1)
+		return t.followNode(n.leaf, pp, pp.width-1)
 	}
-	return t.followNode(n.columns, n.key, n.parent, n.pos-1)
+	return t.followNode(n.leaf, n.parent, n.pos-1)
 }
 
 func (t *Tree) getSucc(n *node) (*node, error) {
@@ -97,74 +169,220 @@ func (t *Tree) getSucc(n *node) (*node, error) {
 		if pp == nil {
 			return nil, nil
 		}
-		return t.followNode(n.columns, n.key, pp, 0)
+		return t.followNode(n.leaf, pp, 0)
 	}
-	return t.followNode(n.columns, n.key, n.parent, n.pos+1)
+	return t.followNode(n.leaf, n.parent, n.pos+1)
 }
 
-func (t *Tree) borrowPre(n, pre *node) error {
-	midpoint := make([]domain.Word, t.key)
-	copy(midpoint, pre.getKey(n.minWidth()))
+// DeleteRange removes every entry with a key between from and to, which bound the range just as
+// they do for GetRange. Subtrees that lie wholly within the range are detached and their blocks
+// freed, without their rows being visited one by one, and only the nodes on the paths to either
+// end of the range are rebalanced. As with a tree grown from an empty block, a tree left with no
+// rows at all holds a row for the zero key. Errors may originate from the block store.
+func (t *Tree) DeleteRange(from, to Bound) (err error) {
+	defer wrapErr(&err, "DeleteRange", from.Key)
 
-	n.setkey(0, n.getKey(0))
-	n.insert(0, pre.getRows(n.minWidth(), pre.width)...)
-	n.setkey(0, make([]domain.Word, t.key))
+	if t.readOnly {
+		return ErrReadOnly
+	}
 
-	pre.clearRows(n.minWidth(), -1)
+	if len(from.Key) > t.key || len(to.Key) > t.key {
+		return ErrKeyWidth
+	}
 
-	n.parent.setkey(n.pos, midpoint)
+	from, to = t.encodeBound(from), t.encodeBound(to)
 
-	return t.writeNodes(n, pre, n.parent)
+	t.beginWrite()
+	defer t.endWrite(&err)
+
+	root, err := t.readNode(t.depth == 0, nil, 0, t.root)
+	if err != nil {
+		return err
+	}
+	_, err = t.deleteSpan(root, t.depth, nil, from, to)
+	if err != nil {
+		return err
+	}
+	if root.width == 0 && !root.leaf {
+		// everything has gone, down to the row for the zero key
+		empty := t.newNode(true)
+		empty.id = root.id
+		t.depth = 0
+		err = t.writeNode(empty)
+		if err != nil {
+			return err
+		}
+	}
+
+	fromPath, toPath := t.firstRow, t.lastRow
+	if from.Key != nil {
+		fromPath = func(n *node) int { return n.probe(from.Key) }
+	}
+	if to.Key != nil {
+		toPath = func(n *node) int { return n.probe(to.Key) }
+	}
+	err = t.rebalancePath(fromPath)
+	if err != nil {
+		return err
+	}
+	return t.rebalancePath(toPath)
 }
 
-func (t *Tree) borrowSucc(n, succ *node) error {
-	amt := succ.width - succ.minWidth()
-	midpoint := make([]domain.Word, t.key)
-	copy(midpoint, succ.getKey(amt))
+// deleteSpan removes the rows between from and to under n, which lies height levels above the
+// leaves and holds keys less than hi, where a nil hi is open. Children of n that are wholly within
+// the range are freed, and children left empty are removed. If n is left empty itself it is not
+// written, and deleteSpan reports that its block is to be freed.
+func (t *Tree) deleteSpan(n *node, height int, hi []domain.Word, from, to Bound) (bool, error) {
+	if n.leaf {
+		return t.deleteRows(n, from, to)
+	}
 
-	succ.setkey(0, succ.getKey(0))
-	n.insert(n.width, succ.getRows(0, amt)...)
-	succ.remove(0, amt)
-	succ.setkey(0, make([]domain.Word, t.key))
+	a, b := 0, n.width-1
+	if from.Key != nil {
+		a = n.probe(from.Key)
+	}
+	if to.Key != nil {
+		b = n.probe(to.Key)
+		if b > a && to.Exclusive && n.order.compare(n.getKey(b), to.Key) == 0 {
+			// the last child starts where the range stops
+			b--
+		}
+	}
 
-	succ.parent.setkey(succ.pos, midpoint)
+	// children are visited from the right, so that removing one leaves the positions of those
+	// still to be visited alone
+	var gone []int
+	for i := b; i >= a; i-- {
+		upper := hi
+		if i+1 < n.width {
+			upper = n.getKey(i + 1)
+		}
 
-	return t.writeNodes(n, succ, succ.parent)
-}
+		id := n.getRow(i)[t.key]
+		covered := a < i && i < b ||
+			!before(n.order, n.getKey(i), from) && (to.Key == nil || upper != nil && n.order.compare(upper, to.Key) >= 0)
+		if covered {
+			err := t.freeSubtree(id, height-1)
+			if err != nil {
+				return false, err
+			}
+			gone = append(gone, i)
+			continue
+		}
 
-func (t *Tree) mergePre(n, pre *node) error {
-	n.setkey(0, n.getKey(0))
-	copy(pre.entries[pre.width*pre.columns:], n.entries[:])
+		child, err := t.followNode(height == 1, n, i)
+		if err != nil {
+			return false, err
+		}
+		empty, err := t.deleteSpan(child, height-1, upper, from, to)
+		if err != nil {
+			return false, err
+		}
+		if empty {
+			err = t.freeBlock(child.id)
+			if err != nil {
+				return false, err
+			}
+			gone = append(gone, i)
+		}
+	}
 
-	err := t.writeNode(pre)
-	if err != nil {
-		return err
+	if len(gone) == 0 {
+		return false, nil
 	}
+	for _, i := range gone {
+		n.remove(i, 1)
+	}
+	if n.width == 0 {
+		return n.parent != nil, nil
+	}
+	return false, t.writeNode(n)
+}
 
-	err = t.deleteFromNode(n.parent, n.pos)
-	if err != nil {
-		return err
+// deleteRows removes the rows between from and to in the leaf n, as deleteSpan does.
+func (t *Tree) deleteRows(n *node, from, to Bound) (bool, error) {
+	start := 0
+	for start < n.width && before(n.order, n.getKey(start), from) {
+		start++
+	}
+	end := start
+	for end < n.width && !after(n.order, n.getKey(end), to) {
+		end++
+	}
+	if start == end {
+		return false, nil
 	}
 
-	return t.store.FreeBlock(n.id)
-}
+	for i := start; i < end; i++ {
+		err := t.freeRow(n.getRow(i))
+		if err != nil {
+			return false, err
+		}
+	}
+	n.remove(start, end-start)
 
-func (t *Tree) mergeSucc(n, succ *node) error {
-	n.setkey(0, n.getKey(0))
-	succ.setkey(0, succ.getKey(0))
-	copy(succ.entries[n.width*n.columns:], succ.entries[:])
-	copy(succ.entries[:n.width*n.columns], n.entries[:])
-	n.setkey(0, make([]domain.Word, t.key))
+	if n.width == 0 && n.parent != nil {
+		return true, nil
+	}
+	return false, t.writeNode(n)
+}
 
-	err := t.writeNode(succ)
-	if err != nil {
-		return err
+// freeSubtree frees the block with the given id, which lies height levels above the leaves, and
+// everything below it.
+func (t *Tree) freeSubtree(id domain.Word, height int) error {
+	if t.cow && !t.fresh[id] {
+		// nothing below a block shared with a snapshot can be fresh, so nothing is to be freed
+		return nil
 	}
 
-	err = t.deleteFromNode(n.parent, n.pos)
-	if err != nil {
-		return err
+	if height > 0 || t.overflow {
+		n, err := t.readNode(height == 0, nil, 0, id)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n.width; i++ {
+			if height > 0 {
+				err = t.freeSubtree(n.getRow(i)[t.key], height-1)
+			} else {
+				err = t.freeRow(n.getRow(i))
+			}
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	return t.store.FreeBlock(n.id)
+	return t.freeBlock(id)
+}
+
+// rebalancePath brings the nodes on the path that choose picks out back up to their minimum width,
+// and removes any root left with a single child. Whenever it changes the tree, it starts again
+// from the leaves, as merging two nodes may leave the children of the merged node underfull.
+func (t *Tree) rebalancePath(choose func(*node) int) error {
+	for level := 0; level <= t.depth; level++ {
+		n, err := t.readNode(t.depth == 0, nil, 0, t.root)
+		if err != nil {
+			return err
+		}
+		for h := t.depth; h > level; h-- {
+			n, err = t.followNode(h == 1, n, choose(n))
+			if err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case n.parent == nil && (n.leaf || n.width > 1):
+			continue
+		case n.parent != nil && (n.width >= n.minWidth() || n.parent.width < 2):
+			continue
+		}
+
+		err = t.balanceTree(n)
+		if err != nil {
+			return err
+		}
+		level = -1
+	}
+	return nil
 }
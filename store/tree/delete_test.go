@@ -1,12 +1,16 @@
 package tree
 
 import (
+	"errors"
+	"math/rand"
 	"strconv"
 	"testing"
 
 	"github.com/catlev/pkg/domain"
 
 	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func assertDeletionSuccess(t *testing.T, tree *Tree, min, max, without domain.Word) {
@@ -112,3 +116,148 @@ func TestDeleteMergeSucc(t *testing.T) {
 
 	assertDeletionSuccess(t, tree, 0, 32, 10)
 }
+
+func TestDeleteRandom(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"InPlace", nil},
+		{"CopyOnWrite", []Option{CopyOnWrite()}},
+		{"CompressKeys", []Option{CompressKeys()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			store := mem.New()
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(3, 2, store, 0, start, test.opts...)
+			expected := map[[2]domain.Word]domain.Word{}
+
+			for i := 1; i <= 6000; i++ {
+				k := [2]domain.Word{domain.Word(rng.Intn(30) + 1), domain.Word(rng.Intn(30))}
+				if rng.Intn(2) == 0 {
+					err := tree.Delete(k[:])
+					_, ok := expected[k]
+					assert.Equal(t, !ok, errors.Is(err, ErrNotFound))
+					delete(expected, k)
+				} else {
+					v := domain.Word(rng.Intn(1000))
+					require.Nil(t, tree.Put([]domain.Word{k[0], k[1], v}))
+					expected[k] = v
+				}
+				if i%20 == 0 {
+					tree.Snapshot()
+				}
+
+				if i%500 != 0 {
+					continue
+				}
+				assertSound(t, tree)
+				for k, v := range expected {
+					assert.Equal(t, v, getRow(t, tree, k[:])[2])
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		columns int
+		opts    []Option
+	}{
+		{"InPlace", 2, nil},
+		{"CopyOnWrite", 2, []Option{CopyOnWrite()}},
+		{"CompressKeys", 2, []Option{CompressKeys()}},
+		{"Counted", 2, []Option{Counted()}},
+		{"Overflow", 20, []Option{Overflow()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			store := &countingStore{Store: *mem.New()}
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(test.columns, 1, store, 0, start, test.opts...)
+			expected := map[domain.Word]bool{0: true}
+
+			bound := func(k domain.Word) Bound {
+				switch rng.Intn(4) {
+				case 0:
+					return Bound{}
+				case 1:
+					return Exclusive([]domain.Word{k})
+				}
+				return Inclusive([]domain.Word{k})
+			}
+
+			for round := 0; round < 30; round++ {
+				for len(expected) < 1500 {
+					k := domain.Word(rng.Intn(3000) + 1)
+					require.Nil(t, tree.Put(wideRow(k, test.columns)))
+					expected[k] = true
+				}
+				if round%5 == 0 {
+					tree.Snapshot()
+				}
+
+				lo := domain.Word(rng.Intn(3000))
+				hi := lo + domain.Word(rng.Intn(1500))
+				from, to := bound(lo), bound(hi)
+				require.Nil(t, tree.DeleteRange(from, to))
+
+				for k := range expected {
+					if !before(nil, []domain.Word{k}, from) && !after(nil, []domain.Word{k}, to) {
+						delete(expected, k)
+					}
+				}
+				if len(expected) == 0 {
+					expected[0] = true
+				}
+
+				assertSound(t, tree)
+				var got []domain.Word
+				r := tree.GetRange(Bound{}, Bound{})
+				for r.Next() {
+					k := r.This()[0]
+					if k != 0 {
+						assert.Equal(t, wideRow(k, test.columns), r.This())
+					}
+					got = append(got, k)
+				}
+				require.Nil(t, r.Err())
+				assert.Len(t, got, len(expected))
+				for _, k := range got {
+					assert.True(t, expected[k])
+				}
+			}
+
+			require.Nil(t, tree.DeleteRange(Bound{}, Bound{}))
+			assertSound(t, tree)
+			assert.Equal(t, 0, tree.Depth())
+			if tree.cow {
+				return
+			}
+			// only the root is left, and every other block has been released
+			assert.Equal(t, 1, store.live)
+		})
+	}
+}
+
+func TestDeleteRangeDetaches(t *testing.T) {
+	var rows [][]domain.Word
+	for k := domain.Word(1); k <= 20000; k++ {
+		rows = append(rows, []domain.Word{k, k})
+	}
+	store := &readCountingStore{Store: mem.New()}
+	tree, err := Load(2, 1, store, newSliceRows(rows...), 1)
+	require.Nil(t, err)
+
+	store.reads = 0
+	require.Nil(t, tree.DeleteRange(Inclusive([]domain.Word{100}), Exclusive([]domain.Word{19900})))
+	assert.Less(t, store.reads, 50)
+	assertSound(t, tree)
+
+	c, err := tree.Count(Bound{}, Bound{})
+	require.Nil(t, err)
+	assert.Equal(t, 1+99+101, c)
+}
@@ -0,0 +1,235 @@
+package tree
+
+import (
+	"reflect"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// A Delta holds the differences between two versions of a tree.
+type Delta struct {
+	// Inserted holds the rows with keys only in the later version.
+	Inserted [][]domain.Word
+	// Updated holds the rows of the later version whose keys are in both, but whose values differ.
+	Updated [][]domain.Word
+	// Deleted holds the rows of the earlier version with keys only in that version.
+	Deleted [][]domain.Word
+}
+
+// Diff finds the rows that differ between a and b, which must have the same columns, key and
+// collations, or else ErrShape is returned. Where both are in copy-on-write mode and in the same
+// block store, such as a snapshot and the tree it was taken from, subtrees that the two share are
+// passed over, so that the work done is in proportion to the changes rather than to the size of
+// the tree. Otherwise every row of each is compared, overflow and all, as the same id may stand for
+// different blocks in different stores, or for a block that has since been freed and reused.
+// Without copy-on-write, blocks are rewritten in place, so a snapshot follows the tree it was taken
+// from rather than standing for an earlier version of it. Errors may originate from the block
+// store.
+func Diff(a, b *Tree) (d *Delta, err error) {
+	defer wrapErr(&err, "Diff", nil)
+
+	if a.columns != b.columns || a.key != b.key || !sameCollations(a, b) {
+		return nil, ErrShape
+	}
+	shared := a.cow && b.cow && sameStore(a.store, b.store)
+
+	va := a.beginRead()
+	defer a.endRead()
+	vb := va
+	if b != a {
+		vb = b.beginRead()
+		defer b.endRead()
+	}
+	ca := &diffCursor{tree: a, version: va, atRoot: true}
+	cb := &diffCursor{tree: b, version: vb, atRoot: true}
+
+	d = &Delta{}
+	for !ca.done() || !cb.done() {
+		switch {
+		case ca.done() || cb.done():
+			c, rows := ca, &d.Deleted
+			if ca.done() {
+				c, rows = cb, &d.Inserted
+			}
+			if c.level() >= 0 {
+				err = c.expand()
+				break
+			}
+			err = c.take(rows)
+
+		case shared && ca.level() >= 0 && ca.level() == cb.level() && ca.id() == cb.id():
+			// the subtree is shared
+			ca.skip()
+			cb.skip()
+
+		case ca.level() >= 0 || cb.level() >= 0:
+			if ca.level() >= cb.level() {
+				err = ca.expand()
+			} else {
+				err = cb.expand()
+			}
+
+		default:
+			err = diffRows(ca, cb, d, shared)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// sameCollations reports whether a and b order and keep their keys the same way. Collations made by
+// Ordered are taken to be the same if they were made from the same function.
+func sameCollations(a, b *Tree) bool {
+	same := func(f, g any) bool {
+		return reflect.ValueOf(f).Pointer() == reflect.ValueOf(g).Pointer()
+	}
+	for i := 0; i < a.key; i++ {
+		var ca, cb Collation
+		if a.collations != nil {
+			ca = a.collations[i]
+		}
+		if b.collations != nil {
+			cb = b.collations[i]
+		}
+		if !same(ca.encode, cb.encode) || !same(ca.compare, cb.compare) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameStore reports whether a and b are the same block store.
+func sameStore(a, b domain.Store) bool {
+	// comparing stores of a type that cannot be compared would panic
+	return reflect.ValueOf(a).Comparable() && a == b
+}
+
+// diffRows compares the rows that two cursors are on, and moves past the lesser.
+func diffRows(ca, cb *diffCursor, d *Delta, shared bool) error {
+	ra, rb := ca.row(), cb.row()
+	switch c := ca.tree.order.compare(ra[:ca.tree.key], rb[:cb.tree.key]); {
+	case c > 0:
+		return ca.take(&d.Deleted)
+	case c < 0:
+		return cb.take(&d.Inserted)
+	}
+
+	ca.skip()
+	if (shared || !ca.tree.overflow && !cb.tree.overflow) && compareValues(ra, rb) == 0 {
+		// the rows are the same, down to where any overflow is kept, which is only to be trusted
+		// where the blocks of the one are those of the other
+		cb.skip()
+		return nil
+	}
+
+	old, err := ca.tree.loadRow(ra)
+	if err != nil {
+		return err
+	}
+	var rows [][]domain.Word
+	err = cb.take(&rows)
+	if err != nil {
+		return err
+	}
+	if compareValues(ca.tree.decodeRow(old), rows[0]) != 0 {
+		d.Updated = append(d.Updated, rows[0])
+	}
+	return nil
+}
+
+// A diffCursor walks a tree in key order, visiting each subtree before the rows in it, so that the
+// rows can be passed over all at once.
+type diffCursor struct {
+	tree    *Tree
+	version *version
+	// before the root is expanded, the cursor is on the root itself
+	atRoot bool
+	frames []diffFrame
+}
+
+type diffFrame struct {
+	n     *node
+	i     int
+	level int
+}
+
+func (c *diffCursor) done() bool {
+	return !c.atRoot && len(c.frames) == 0
+}
+
+// level gives the level of the subtree the cursor is on, or -1 if it is on a row.
+func (c *diffCursor) level() int {
+	if c.atRoot {
+		return c.version.depth
+	}
+	f := c.frames[len(c.frames)-1]
+	return f.level - 1
+}
+
+func (c *diffCursor) id() domain.Word {
+	if c.atRoot {
+		return c.version.root
+	}
+	f := c.frames[len(c.frames)-1]
+	return f.n.getRow(f.i)[c.tree.key]
+}
+
+func (c *diffCursor) row() []domain.Word {
+	f := c.frames[len(c.frames)-1]
+	return f.n.getRow(f.i)
+}
+
+// expand moves the cursor into the subtree it is on.
+func (c *diffCursor) expand() error {
+	level := c.level()
+
+	var n *node
+	var err error
+	if c.atRoot {
+		n, err = c.tree.readNode(level == 0, nil, 0, c.version.root)
+		c.atRoot = false
+	} else {
+		f := c.frames[len(c.frames)-1]
+		n, err = c.tree.followNode(level == 0, f.n, f.i)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.frames = append(c.frames, diffFrame{n: n, level: level})
+	return nil
+}
+
+// take adds the row the cursor is on to rows, and moves past it.
+func (c *diffCursor) take(rows *[][]domain.Word) error {
+	row, err := c.tree.loadRow(c.row())
+	if err != nil {
+		return err
+	}
+	*rows = append(*rows, c.tree.decodeRow(row))
+	c.skip()
+	return nil
+}
+
+// skip moves past the subtree or row the cursor is on.
+func (c *diffCursor) skip() {
+	if c.atRoot {
+		c.atRoot = false
+		return
+	}
+
+	c.frames[len(c.frames)-1].i++
+	for len(c.frames) > 0 {
+		f := &c.frames[len(c.frames)-1]
+		if f.i < f.n.width {
+			return
+		}
+		c.frames = c.frames[:len(c.frames)-1]
+		if len(c.frames) > 0 {
+			c.frames[len(c.frames)-1].i++
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type readCountingStore struct {
+	*mem.Store
+	reads int
+}
+
+func (s *readCountingStore) ReadBlock(id domain.Word, b *domain.Block) error {
+	s.reads++
+	return s.Store.ReadBlock(id, b)
+}
+
+func sortRows(rows [][]domain.Word) [][]domain.Word {
+	sort.Slice(rows, func(i, j int) bool { return compareValues(rows[i], rows[j]) > 0 })
+	return rows
+}
+
+func TestDiff(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		columns int
+		opts    []Option
+	}{
+		{"Narrow", 2, nil},
+		{"Overflow", 20, []Option{Overflow()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := &readCountingStore{Store: mem.New()}
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(test.columns, 1, store, 0, start, append(test.opts, CopyOnWrite())...)
+			for i := 1; i <= 5000; i++ {
+				require.Nil(t, tree.Put(wideRow(domain.Word(i), test.columns)))
+			}
+			before := tree.Snapshot()
+
+			var expected Delta
+			for _, k := range []domain.Word{10, 2000, 4999} {
+				require.Nil(t, tree.Delete(key(k)))
+				expected.Deleted = append(expected.Deleted, wideRow(k, test.columns))
+			}
+			for _, k := range []domain.Word{6000, 6001} {
+				require.Nil(t, tree.Put(wideRow(k, test.columns)))
+				expected.Inserted = append(expected.Inserted, wideRow(k, test.columns))
+			}
+			// putting a row back as it was is no change
+			require.Nil(t, tree.Put(wideRow(3000, test.columns)))
+			updated := wideRow(3001, test.columns)
+			updated[test.columns-1]++
+			require.Nil(t, tree.Put(updated))
+			expected.Updated = append(expected.Updated, updated)
+
+			store.reads = 0
+			d, err := Diff(before, tree)
+			require.Nil(t, err)
+			assert.Equal(t, &expected, d)
+			assert.Less(t, store.reads, 100)
+
+			d, err = Diff(tree, before)
+			require.Nil(t, err)
+			assert.Equal(t, expected.Inserted, d.Deleted)
+			assert.Equal(t, expected.Deleted, d.Inserted)
+			assert.Equal(t, [][]domain.Word{wideRow(3001, test.columns)}, d.Updated)
+
+			d, err = Diff(tree, tree)
+			require.Nil(t, err)
+			assert.Equal(t, &Delta{}, d)
+		})
+	}
+}
+
+func TestDiffUnshared(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := mem.New()
+	startA, _ := store.AddBlock(&domain.Block{})
+	startB, _ := store.AddBlock(&domain.Block{})
+	a := New(2, 1, store, 0, startA)
+	b := New(2, 1, store, 0, startB)
+
+	rows := map[domain.Word][2]domain.Word{}
+	for i := 0; i < 3000; i++ {
+		k := domain.Word(rng.Intn(2000) + 1)
+		va, vb := domain.Word(rng.Intn(3)), domain.Word(rng.Intn(3))
+		switch rng.Intn(3) {
+		case 0:
+			require.Nil(t, a.Put([]domain.Word{k, va}))
+			rows[k] = [2]domain.Word{va, rows[k][1]}
+		case 1:
+			require.Nil(t, b.Put([]domain.Word{k, vb}))
+			rows[k] = [2]domain.Word{rows[k][0], vb}
+		default:
+			require.Nil(t, a.Put([]domain.Word{k, va}))
+			require.Nil(t, b.Put([]domain.Word{k, vb}))
+			rows[k] = [2]domain.Word{va, vb}
+		}
+	}
+
+	var expected Delta
+	for k, v := range rows {
+		_, errA := a.Get(key(k))
+		_, errB := b.Get(key(k))
+		switch {
+		case errors.Is(errA, ErrNotFound):
+			expected.Inserted = append(expected.Inserted, []domain.Word{k, v[1]})
+		case errors.Is(errB, ErrNotFound):
+			expected.Deleted = append(expected.Deleted, []domain.Word{k, v[0]})
+		case v[0] != v[1]:
+			expected.Updated = append(expected.Updated, []domain.Word{k, v[1]})
+		}
+	}
+
+	d, err := Diff(a, b)
+	require.Nil(t, err)
+	assert.Equal(t, sortRows(expected.Inserted), d.Inserted)
+	assert.Equal(t, sortRows(expected.Deleted), d.Deleted)
+	assert.Equal(t, sortRows(expected.Updated), d.Updated)
+
+	_, err = Diff(a, New(3, 1, store, 0, startA))
+	assert.True(t, errors.Is(err, ErrShape))
+}
+
+func TestDiffInPlace(t *testing.T) {
+	store := &readCountingStore{Store: mem.New()}
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start)
+	for i := 1; i <= 2000; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), 1}))
+	}
+	other := tree.Snapshot()
+	for i := 1; i <= 2000; i += 7 {
+		require.Nil(t, tree.Delete(key(domain.Word(i))))
+	}
+
+	// the blocks of the two are shared, but are read all the same
+	store.reads = 0
+	d, err := Diff(other, tree)
+	require.Nil(t, err)
+	assert.Empty(t, d.Inserted)
+	assert.Empty(t, d.Updated)
+	assert.Empty(t, d.Deleted)
+	assert.Greater(t, store.reads, 2*2000/32)
+}
+
+func TestDiffCollations(t *testing.T) {
+	store := mem.New()
+	startA, _ := store.AddBlock(&domain.Block{})
+	startB, _ := store.AddBlock(&domain.Block{})
+	byValue := func(a, b domain.Word) int { return int(a) - int(b) }
+
+	for _, test := range []struct {
+		name  string
+		a, b  []Option
+		shape bool
+	}{
+		{"Default", nil, []Option{Collate(Unsigned)}, true},
+		{"Signed", nil, []Option{Collate(Signed)}, false},
+		{"Descending", []Option{Collate(Signed)}, []Option{Collate(Descending)}, false},
+		{"SameOrdered", []Option{Collate(Ordered(byValue))}, []Option{Collate(Ordered(byValue))}, true},
+		{"Ordered", nil, []Option{Collate(Ordered(byValue))}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Diff(New(2, 1, store, 0, startA, test.a...), New(2, 1, store, 0, startB, test.b...))
+			assert.Equal(t, !test.shape, errors.Is(err, ErrShape))
+		})
+	}
+}
+
+func TestDiffStores(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		columns int
+		opts    []Option
+	}{
+		{"CopyOnWrite", 2, []Option{CopyOnWrite()}},
+		{"Overflow", 20, []Option{Overflow()}},
+		{"Both", 20, []Option{Overflow(), CopyOnWrite()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// the two trees are laid out alike, block for block, but in stores of their own
+			var trees [2]*Tree
+			for i := range trees {
+				store := mem.New()
+				start, _ := store.AddBlock(&domain.Block{})
+				trees[i] = New(test.columns, 1, store, 0, start, test.opts...)
+				for k := 1; k <= 500; k++ {
+					row := wideRow(domain.Word(k), test.columns)
+					row[test.columns-1] += domain.Word(i)
+					require.Nil(t, trees[i].Put(row))
+				}
+			}
+			require.Equal(t, trees[0].Root(), trees[1].Root())
+
+			d, err := Diff(trees[0], trees[1])
+			require.Nil(t, err)
+			assert.Len(t, d.Updated, 500)
+			assert.Empty(t, d.Inserted)
+			assert.Empty(t, d.Deleted)
+		})
+	}
+}
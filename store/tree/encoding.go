@@ -0,0 +1,143 @@
+package tree
+
+import (
+	"sort"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// Without compression, a block holds the rows of a node one after another, and the first row
+// after the first whose key is all zeros marks the end of the node.
+//
+// With compression, the first word of a block gives the number of rows in the low half and the
+// length of the key prefix that they share in the high half. The prefix follows, and then each
+// row without it. The key of the first row of an interior node is implied by the parent, and so
+// plays no part in the prefix. An empty block holds the single row with the zero key, just as it
+// does without compression.
+
+// encode gives the block that holds n, or ErrNodeFull if its rows do not fit in one.
+func (n *node) encode() (*domain.Block, error) {
+	if !n.fits() {
+		return nil, ErrNodeFull
+	}
+
+	var b domain.Block
+
+	if !n.compress {
+		copy(b[:], n.entries)
+		return &b, nil
+	}
+
+	p := n.prefixLen(0, n.width)
+	b[0] = domain.Word(n.width) | domain.Word(p)<<32
+	if p > 0 {
+		copy(b[1:], n.getRow(n.width - 1)[:p])
+	}
+
+	stride := n.columns - p
+	for i := 0; i < n.width; i++ {
+		copy(b[1+p+i*stride:], n.getRow(i)[p:])
+	}
+
+	return &b, nil
+}
+
+func (n *node) decode(b *domain.Block) error {
+	if !n.compress {
+		n.width = sort.Search(n.maxWidth(), func(i int) bool {
+			if i == 0 {
+				return false
+			}
+			for _, k := range b[i*n.columns : i*n.columns+n.key] {
+				if k != 0 {
+					return false
+				}
+			}
+			return true
+		})
+		n.entries = append(n.entries[:0], b[:n.width*n.columns]...)
+		return nil
+	}
+
+	width := int(b[0] & 0xffffffff)
+	p := int(b[0] >> 32)
+	if width == 0 {
+		width = 1
+	}
+	stride := n.columns - p
+	if p > n.key || 1+p+width*stride > domain.WordSize {
+		return ErrBadNode
+	}
+
+	n.width = width
+	n.entries = make([]domain.Word, width*n.columns)
+	for i := 0; i < width; i++ {
+		row := n.getRow(i)
+		copy(row, b[1:1+p])
+		copy(row[p:], b[1+p+i*stride:1+p+(i+1)*stride])
+	}
+
+	return nil
+}
+
+// prefixLen gives the length of the key prefix shared by the rows from one index up to another,
+// were they to make up a node by themselves.
+func (n *node) prefixLen(from, to int) int {
+	if !n.leaf {
+		from++
+	}
+	if from >= to {
+		return 0
+	}
+
+	// the rows are in order, so the first and last have the least in common
+	first := n.getRow(from)[:n.key]
+	last := n.getRow(to - 1)[:n.key]
+	p := 0
+	for p < n.key && first[p] == last[p] {
+		p++
+	}
+	return p
+}
+
+// sizeOf gives the number of words needed to encode the rows from one index up to another as a
+// node by themselves.
+func (n *node) sizeOf(from, to int) int {
+	if !n.compress {
+		return (to - from) * n.columns
+	}
+	p := n.prefixLen(from, to)
+	return 1 + p + (to-from)*(n.columns-p)
+}
+
+func (n *node) fits() bool {
+	return n.sizeOf(0, n.width) <= domain.WordSize
+}
+
+// fitsWith reports whether the rows of right would fit in n alongside its own.
+func (n *node) fitsWith(right *node) bool {
+	joined := n.clone()
+	joined.insert(joined.width, right.getRows(0, right.width)...)
+	return joined.fits()
+}
+
+// splitPoint finds where to divide the rows of n so that both parts fit in a block, as near to
+// the middle as possible, or gives ErrNodeFull if there is nowhere that they do.
+func (n *node) splitPoint() (int, error) {
+	mid := n.width / 2
+	for d := 0; d <= mid; d++ {
+		for _, k := range []int{mid - d, mid + d} {
+			if k > 0 && k < n.width &&
+				n.sizeOf(0, k) <= domain.WordSize && n.sizeOf(k, n.width) <= domain.WordSize {
+				return k, nil
+			}
+		}
+	}
+	return 0, ErrNodeFull
+}
+
+func (n *node) clone() *node {
+	c := *n
+	c.entries = append([]domain.Word(nil), n.entries...)
+	return &c
+}
@@ -11,6 +11,15 @@ var (
 	ErrNotFound = errors.New("not found")
 	ErrBadRow   = errors.New("bad row")
 	ErrKeyWidth = errors.New("wrong number of values in key")
+	ErrReadOnly = errors.New("tree is read only")
+	ErrUnsorted = errors.New("rows out of order")
+	ErrBadNode  = errors.New("malformed node")
+	ErrNodeFull = errors.New("rows do not fit in a node")
+	ErrChanged  = errors.New("tree changed during iteration")
+	ErrShape    = errors.New("trees differ in shape")
+	ErrExists   = errors.New("already exists")
+	ErrMismatch = errors.New("row does not match")
+	ErrAborted  = errors.New("update aborted")
 )
 
 type TreeError struct {
@@ -0,0 +1,115 @@
+package tree
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/stream"
+)
+
+// Export writes every row of t to w in key order, as a record named row with a field for each
+// column. The fields are named after the columns by names, which must give one name for each
+// column if it is given at all; otherwise the columns are named c0, c1 and so on. Values are
+// written as unsigned integers, whatever their collation. The row for the zero key that every tree
+// holds is left out while it is all zeros, as Import has no need of it. Errors may originate from
+// the block store or from w.
+func Export(t *Tree, w *stream.Writer, names ...string) (err error) {
+	defer wrapErr(&err, "Export", nil)
+
+	names, err = columnNames(t, names)
+	if err != nil {
+		return err
+	}
+
+	empty := make([]domain.Word, t.columns)
+	r := t.GetRange(Bound{}, Bound{})
+	for r.Next() && w.Err() == nil {
+		row := r.This()
+		if compareValues(t.encodeRow(row), empty) == 0 {
+			continue
+		}
+		w.Record("row", func(w *stream.Writer) {
+			for i, v := range row {
+				w.UintField(names[i], uint64(v))
+			}
+		})
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return w.Err()
+}
+
+// Import puts the rows that r holds into t, in the form that Export writes them. Each row must
+// have a field for every column, and no others, or else ErrBadRow is returned. Errors may also
+// originate from the block store or from r.
+func Import(r *stream.Reader, t *Tree, names ...string) (err error) {
+	defer wrapErr(&err, "Import", nil)
+
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	names, err = columnNames(t, names)
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, name := range names {
+		columns[name] = i
+	}
+
+	for r.Next() {
+		if r.Name() != "row" || r.Kind() != stream.Record {
+			return fmt.Errorf("unexpected %s: %w", r.Name(), ErrBadRow)
+		}
+
+		row := make([]domain.Word, t.columns)
+		seen := make([]bool, t.columns)
+		fields := r.Record()
+		for fields.Next() {
+			i, ok := columns[fields.Name()]
+			if !ok || seen[i] || fields.Kind() != stream.Field {
+				return fmt.Errorf("unexpected %s: %w", fields.Name(), ErrBadRow)
+			}
+			row[i] = domain.Word(fields.UintField())
+			seen[i] = true
+		}
+		if err = r.Err(); err != nil {
+			return err
+		}
+		for i, ok := range seen {
+			if !ok {
+				return fmt.Errorf("missing %s: %w", names[i], ErrBadRow)
+			}
+		}
+
+		err = t.importRow(row)
+		if err != nil {
+			return err
+		}
+	}
+	r.ExpectEOF()
+	return r.Err()
+}
+
+func (t *Tree) importRow(row []domain.Word) (err error) {
+	t.beginWrite()
+	defer t.endWrite(&err)
+
+	return t.put(t.encodeRow(row))
+}
+
+func columnNames(t *Tree, names []string) ([]string, error) {
+	if names == nil {
+		names = make([]string, t.columns)
+		for i := range names {
+			names[i] = "c" + strconv.Itoa(i)
+		}
+	}
+	if len(names) != t.columns {
+		return nil, ErrBadRow
+	}
+	return names, nil
+}
@@ -0,0 +1,70 @@
+package tree
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	tree := newTestTree(3, 1, Collate(Signed))
+	for k := -100; k <= 100; k++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(k), domain.Word(k * k), 1 << 63}))
+	}
+
+	var buf strings.Builder
+	w := stream.NewWriter(&buf)
+	w.Indent, w.LineEnd = "\t", "\n"
+	require.Nil(t, Export(tree, w, "id", "square", "flag"))
+	assert.True(t, strings.HasPrefix(buf.String(), "row{\n\tid:\"18446744073709551516\"\n\tsquare:\"10000\"\n"))
+	assert.Equal(t, 201, strings.Count(buf.String(), "row{"))
+
+	copied := newTestTree(3, 1, Collate(Signed))
+	require.Nil(t, Import(stream.NewReader(strings.NewReader(buf.String())), copied, "id", "square", "flag"))
+	d, err := Diff(tree, copied)
+	require.Nil(t, err)
+	assert.Equal(t, &Delta{}, d)
+}
+
+func TestImportFixture(t *testing.T) {
+	tree := newTestTree(2, 1)
+	require.Nil(t, Import(stream.NewReader(strings.NewReader(`
+		// rows need not be in order
+		row { c0: "3" c1: "30" }
+		row { c1: "10" c0: "1" }
+	`)), tree))
+	assert.Equal(t, []domain.Word{1, 10}, getRow(t, tree, []domain.Word{1}))
+	assert.Equal(t, []domain.Word{3, 30}, getRow(t, tree, []domain.Word{3}))
+
+	for _, in := range []string{
+		`row { c0: "1" }`,
+		`row { c0: "1" c1: "2" c2: "3" }`,
+		`row { c0: "1" c0: "2" }`,
+		`col { c0: "1" c1: "2" }`,
+		`row { c0: "1" c1 { } }`,
+	} {
+		err := Import(stream.NewReader(strings.NewReader(in)), tree)
+		assert.ErrorIs(t, err, ErrBadRow, in)
+	}
+
+	err := Import(stream.NewReader(strings.NewReader(`row { c0: "1" c1: "x" }`)), tree)
+	assert.NotNil(t, err)
+	assert.Equal(t, []domain.Word{1, 10}, getRow(t, tree, []domain.Word{1}))
+}
+
+func TestExportZeroKey(t *testing.T) {
+	tree := newTestTree(2, 1)
+
+	var buf strings.Builder
+	require.Nil(t, Export(tree, stream.NewWriter(&buf)))
+	assert.Empty(t, buf.String())
+
+	// once it holds something, the row for the zero key is exported like any other
+	require.Nil(t, tree.Put([]domain.Word{0, 5}))
+	require.Nil(t, Export(tree, stream.NewWriter(&buf)))
+	assert.Equal(t, `row{c0:"0"c1:"5"}`, buf.String())
+}
@@ -2,12 +2,40 @@ package tree
 
 import "github.com/catlev/pkg/domain"
 
+// A Bound limits one end of a range of keys. The zero Bound leaves that end of the range open.
+type Bound struct {
+	Key       []domain.Word
+	Exclusive bool
+	// prefix makes the bound stand for every key that starts with Key
+	prefix bool
+}
+
+// Inclusive gives a bound that admits the key itself.
+func Inclusive(key []domain.Word) Bound {
+	return Bound{Key: key}
+}
+
+// Exclusive gives a bound that stops short of the key itself.
+func Exclusive(key []domain.Word) Bound {
+	return Bound{Key: key, Exclusive: true}
+}
+
+// A Range iterates over the entries of a tree between two bounds, in either direction. It starts
+// out unpositioned: the first call to Next moves to the first entry in the range, and the first
+// call to Prev moves to the last.
+//
+// A range over a copy-on-write tree keeps to the version of the tree it started on, however the
+// tree changes afterwards. Otherwise the blocks under the range may be overwritten, and so once the
+// tree has changed the range fails with ErrChanged.
 type Range struct {
-	tree *Tree
-	node *node
-	key  []domain.Word
-	pos  int
-	err  error
+	tree     *Tree
+	op       string
+	from, to Bound
+	version  *version
+	node     *node
+	pos      int
+	row      []domain.Word
+	err      error
 }
 
 // Get queries the tree using the given key, yielding the associated value. If no value has been
@@ -20,58 +48,135 @@ func (t *Tree) Get(key []domain.Word) (v []domain.Word, err error) {
 		return nil, ErrKeyWidth
 	}
 
-	n, err := t.findNode(key)
+	cur := t.beginRead()
+	defer t.endRead()
+
+	stored := t.encodeKey(key)
+	n, err := t.findNode(cur, stored)
 	if err != nil {
 		return nil, err
 	}
 
-	idx := n.probe(key)
+	idx := n.probe(stored)
 	candidate := n.getKey(idx)
 
-	if compareValues(candidate, key) != 0 {
+	if compareValues(candidate, stored) != 0 {
 		return nil, ErrNotFound
 	}
 
-	return n.getRow(idx), nil
-}
-
-// GetRange queries the tree using the given key and returns an iterator over entries of the tree,
-// starting with the largest key that is less than or equal to the given key.
-func (t *Tree) GetRange(key []domain.Word) *Range {
-	n, err := t.findNode(key)
-	pos := 0
-	if n != nil {
-		pos = n.probe(key)
+	row, err := t.loadRow(n.getRow(idx))
+	if err != nil {
+		return nil, err
 	}
+	return t.decodeRow(row), nil
+}
 
+// GetRange returns an iterator over the entries of the tree with keys between from and to. Keys
+// shorter than the key of the tree compare below every longer key that they are a prefix of.
+func (t *Tree) GetRange(from, to Bound) *Range {
 	return &Range{
 		tree: t,
-		node: n,
-		key:  key,
-		pos:  pos - 1,
-		err:  err,
+		op:   "GetRange",
+		from: t.encodeBound(from),
+		to:   t.encodeBound(to),
+	}
+}
+
+// Scan returns an iterator over the entries of the tree whose keys start with the given prefix,
+// which may be anything from empty up to the full width of the key.
+func (t *Tree) Scan(prefix []domain.Word) *Range {
+	r := t.GetRange(Inclusive(prefix), Bound{Key: prefix, prefix: true})
+	r.op = "Scan"
+	if len(prefix) > t.key {
+		r.err = ErrKeyWidth
+	}
+	if len(prefix) == 0 {
+		r.from, r.to = Bound{}, Bound{}
 	}
+	return r
 }
 
+// Next moves to the next entry in the range, reporting whether there is one.
 func (r *Range) Next() bool {
-	if r.err != nil {
+	if !r.enter() {
 		return false
 	}
+	defer r.leave()
 
-	r.pos++
+	if r.node == nil {
+		if r.from.Key == nil {
+			return r.start(r.tree.firstRow, 1, nil)
+		}
+		return r.start(func(n *node) int { return n.probe(r.from.Key) }, 1, r.from.Key)
+	}
 
-	if r.pos < r.node.width {
-		return true
+	return r.found(r.step(1) && r.inRange())
+}
+
+// Prev moves to the previous entry in the range, reporting whether there is one.
+func (r *Range) Prev() bool {
+	if !r.enter() {
+		return false
 	}
+	defer r.leave()
 
-	n, ok := r.loadNextNode(r.node)
+	if r.node == nil {
+		if r.to.Key == nil {
+			return r.start(r.tree.lastRow, -1, nil)
+		}
+		if r.to.prefix {
+			return r.start(func(n *node) int { return n.probePrefix(r.to.Key) }, -1, nil)
+		}
+		return r.start(func(n *node) int { return n.probe(r.to.Key) }, -1, nil)
+	}
+
+	return r.found(r.step(-1) && r.inRange())
+}
+
+// Seek moves to the first entry in the range with a key no less than the given key, reporting
+// whether there is one. An open range is repositioned from the lowest node that the key falls
+// under, rather than from the root.
+func (r *Range) Seek(key []domain.Word) bool {
+	if !r.enter() {
+		return false
+	}
+	defer r.leave()
+
+	key = r.tree.encodeKey(key)
+	if r.from.Key != nil && r.tree.order.compare(key, r.from.Key) > 0 {
+		key = r.from.Key
+	}
+
+	probe := func(n *node) int { return n.probe(key) }
+
+	if r.node == nil {
+		return r.start(probe, 1, key)
+	}
+
+	// climb to the lowest ancestor that a descent from the root for key would pass through
+	top, height := r.node, 0
+	for n, h := r.node, 0; n.parent != nil; n, h = n.parent, h+1 {
+		if !n.bounds(key) {
+			top, height = n.parent, h+1
+		}
+	}
+
+	n, err := r.tree.descend(top, height, probe)
+	if err != nil {
+		r.err = err
+		return false
+	}
 	r.node = n
-	r.pos = 0
+	r.pos = probe(n) - 1
 
-	return ok
+	return r.found(r.advance(key))
 }
 
+// This gives the entry the range is positioned on.
 func (r *Range) This() []domain.Word {
+	if r.tree.overflow || r.tree.coded {
+		return r.row
+	}
 	return r.node.getRow(r.pos)
 }
 
@@ -80,32 +185,179 @@ func (r *Range) Err() error {
 		return nil
 	}
 	return &TreeError{
-		Op:  "GetRange",
-		Key: r.key,
+		Op:  r.op,
+		Key: r.tree.decodeRow(r.from.Key),
 		Err: r.err,
 	}
 }
 
-func (r *Range) loadNextNode(n *node) (*node, bool) {
-	if n.parent == nil {
-		return nil, false
+// enter begins a move of the range, reporting whether it may go ahead. Unless enter returns false,
+// leave must be called once the move is done.
+func (r *Range) enter() bool {
+	if r.err != nil {
+		return false
+	}
+
+	t := r.tree
+	if t.cow {
+		if r.version == nil {
+			r.version = t.pin()
+		}
+		return true
+	}
+
+	v := t.beginRead()
+	if r.version == nil {
+		r.version = v
+	}
+	if v != r.version {
+		t.endRead()
+		r.err = ErrChanged
+		return false
+	}
+	return true
+}
+
+func (r *Range) leave() {
+	if !r.tree.cow {
+		r.tree.endRead()
 	}
+}
 
-	next := n.pos + 1
+// start descends to an entry using choose, then steps from it in the given direction until it
+// reaches the near end of the range. Stepping forward also skips any entries with keys below key.
+func (r *Range) start(choose func(*node) int, dir int, key []domain.Word) bool {
+	n, err := r.tree.findLeaf(r.version, choose)
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.node = n
+	r.pos = choose(n) - dir
 
-	if next >= n.parent.width {
-		p, ok := r.loadNextNode(n.parent)
-		if !ok {
-			return nil, false
+	if dir > 0 {
+		return r.found(r.advance(key))
+	}
+	for r.step(-1) {
+		if !r.afterTo() {
+			return r.found(r.inRange())
 		}
-		n.parent = p
 	}
+	return false
+}
 
-	p, err := r.tree.followNode(n.columns, n.key, n.parent, next)
+// found completes a move of the range, reassembling or decoding the entry it landed on if need be.
+func (r *Range) found(ok bool) bool {
+	if !ok || !r.tree.overflow && !r.tree.coded {
+		return ok
+	}
+
+	row, err := r.tree.loadRow(r.node.getRow(r.pos))
 	if err != nil {
 		r.err = err
-		return nil, false
+		return false
+	}
+	r.row = r.tree.decodeRow(row)
+
+	return true
+}
+
+// advance steps forward to the first entry with a key no less than key that is also past the
+// lower bound of the range.
+func (r *Range) advance(key []domain.Word) bool {
+	for r.step(1) {
+		if r.tree.order.compare(r.thisKey(), key) <= 0 && !r.beforeFrom() {
+			return r.inRange()
+		}
+	}
+	return false
+}
+
+// step moves one entry in the given direction, crossing into neighbouring leaves as needed. At
+// either end of the tree, the range is left just beyond the last entry.
+func (r *Range) step(dir int) bool {
+	r.pos += dir
+
+	for r.pos < 0 || r.pos >= r.node.width {
+		var n *node
+		var err error
+		if dir > 0 {
+			n, err = r.tree.getSucc(r.node)
+		} else {
+			n, err = r.tree.getPre(r.node)
+		}
+		if err != nil {
+			r.err = err
+			return false
+		}
+		if n == nil {
+			r.pos = max(min(r.pos, r.node.width), -1)
+			return false
+		}
+
+		r.node = n
+		r.pos = 0
+		if dir < 0 {
+			r.pos = n.width - 1
+		}
 	}
 
-	return p, true
+	return true
+}
+
+func (r *Range) inRange() bool {
+	return !r.beforeFrom() && !r.afterTo()
+}
+
+func (r *Range) beforeFrom() bool {
+	return before(r.tree.order, r.thisKey(), r.from)
+}
+
+func (r *Range) afterTo() bool {
+	return after(r.tree.order, r.thisKey(), r.to)
+}
+
+// before reports whether key lies below the range that b is the lower bound of.
+func before(o order, key []domain.Word, b Bound) bool {
+	if b.Key == nil {
+		return false
+	}
+	c := o.compare(key, b.Key)
+	return c > 0 || (c == 0 && b.Exclusive)
+}
+
+// after reports whether key lies above the range that b is the upper bound of.
+func after(o order, key []domain.Word, b Bound) bool {
+	if b.Key == nil {
+		return false
+	}
+	if b.prefix {
+		key = key[:len(b.Key)]
+	}
+	c := o.compare(key, b.Key)
+	return c < 0 || (c == 0 && b.Exclusive)
+}
+
+func (r *Range) thisKey() []domain.Word {
+	return r.node.getRow(r.pos)[:r.tree.key]
+}
+
+func (t *Tree) firstRow(n *node) int {
+	return 0
+}
+
+func (t *Tree) lastRow(n *node) int {
+	return n.width - 1
+}
+
+// bounds reports whether key lies within the separators that n's parent gives it.
+func (n *node) bounds(key []domain.Word) bool {
+	p := n.parent
+	if n.pos > 0 && n.order.compare(p.getKey(n.pos), key) < 0 {
+		return false
+	}
+	if n.pos+1 < p.width && n.order.compare(p.getKey(n.pos+1), key) >= 0 {
+		return false
+	}
+	return true
 }
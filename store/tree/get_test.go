@@ -1,10 +1,13 @@
 package tree
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/catlev/pkg/domain"
 	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func assertTreeProperty(t *testing.T, i int, k domain.Word) {
@@ -59,7 +62,7 @@ func TestProbe(t *testing.T) {
 	store := mem.New()
 	start, _ := store.AddBlock(buildBlock(0))
 	tree := New(2, 1, store, 0, start)
-	node, _ := tree.findNode([]domain.Word{0})
+	node, _ := tree.findNode(tree.working(), []domain.Word{0})
 
 	t.Log(node)
 
@@ -75,7 +78,7 @@ func TestWideProbe(t *testing.T) {
 	store := mem.New()
 	start, _ := store.AddBlock(buildBlock2(0))
 	tree := New(4, 2, store, 0, start)
-	node, _ := tree.findNode([]domain.Word{0, 0})
+	node, _ := tree.findNode(tree.working(), []domain.Word{0, 0})
 
 	t.Log(node)
 
@@ -95,7 +98,7 @@ func TestGetRange(t *testing.T) {
 	tree := New(2, 1, store, 1, start)
 
 	for i := 0; i < 64; i++ {
-		r := tree.GetRange([]domain.Word{domain.Word(i)})
+		r := tree.GetRange(Inclusive([]domain.Word{domain.Word(i)}), Bound{})
 		j := i
 
 		for r.Next() {
@@ -117,7 +120,7 @@ func TestWideKey(t *testing.T) {
 	tree := New(4, 2, store, 1, start)
 
 	for i := 0; i < 32; i++ {
-		r := tree.GetRange([]domain.Word{domain.Word(i), domain.Word(i * 2)})
+		r := tree.GetRange(Inclusive([]domain.Word{domain.Word(i), domain.Word(i * 2)}), Bound{})
 		j := i
 
 		for r.Next() {
@@ -139,7 +142,7 @@ func TestWideKeyPartial(t *testing.T) {
 	tree := New(4, 2, store, 1, start)
 
 	for i := 0; i < 32; i++ {
-		r := tree.GetRange([]domain.Word{domain.Word(i), domain.Word(i * 2)})
+		r := tree.GetRange(Inclusive([]domain.Word{domain.Word(i), domain.Word(i * 2)}), Bound{})
 		j := i
 
 		for r.Next() {
@@ -152,3 +155,172 @@ func TestWideKeyPartial(t *testing.T) {
 		}
 	}
 }
+
+func collectRange(t *testing.T, r *Range, dir int) []domain.Word {
+	t.Helper()
+	var keys []domain.Word
+	step := r.Next
+	if dir < 0 {
+		step = r.Prev
+	}
+	for step() {
+		keys = append(keys, r.This()[0])
+	}
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+	return keys
+}
+
+func keySpan(from, to domain.Word) []domain.Word {
+	var keys []domain.Word
+	for k := from; k != to; {
+		keys = append(keys, k)
+		if from < to {
+			k++
+		} else {
+			k--
+		}
+	}
+	return keys
+}
+
+func key(k domain.Word) []domain.Word {
+	return []domain.Word{k}
+}
+
+func TestGetRangeBounds(t *testing.T) {
+	store := mem.New()
+	d1, _ := store.AddBlock(buildBlock(0))
+	d2, _ := store.AddBlock(buildBlock(32))
+	start, _ := store.AddBlock(&domain.Block{0, d1, 32, d2})
+	tree := New(2, 1, store, 1, start)
+
+	for _, test := range []struct {
+		name     string
+		from, to Bound
+		expected []domain.Word
+	}{
+		{"Open", Bound{}, Bound{}, keySpan(0, 64)},
+		{"Inclusive", Inclusive(key(10)), Inclusive(key(40)), keySpan(10, 41)},
+		{"Exclusive", Exclusive(key(10)), Exclusive(key(40)), keySpan(11, 40)},
+		{"OpenStart", Bound{}, Exclusive(key(5)), keySpan(0, 5)},
+		{"OpenEnd", Exclusive(key(60)), Bound{}, keySpan(61, 64)},
+		{"Beyond", Inclusive(key(100)), Bound{}, nil},
+		{"Empty", Exclusive(key(10)), Exclusive(key(11)), nil},
+		{"Shorter", Inclusive(nil), Inclusive(key(2)), keySpan(0, 3)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, collectRange(t, tree.GetRange(test.from, test.to), 1))
+
+			var reversed []domain.Word
+			for i := len(test.expected) - 1; i >= 0; i-- {
+				reversed = append(reversed, test.expected[i])
+			}
+			assert.Equal(t, reversed, collectRange(t, tree.GetRange(test.from, test.to), -1))
+		})
+	}
+}
+
+func TestRangeLatest(t *testing.T) {
+	tree, err := Load(2, 1, mem.New(), countingRows(1, 1000), 0.5)
+	require.Nil(t, err)
+
+	r := tree.GetRange(Bound{}, Exclusive(key(900)))
+	var latest []domain.Word
+	for len(latest) < 50 && r.Prev() {
+		latest = append(latest, r.This()[0])
+	}
+
+	assert.Equal(t, keySpan(899, 849), latest)
+}
+
+func TestRangeChangeDirection(t *testing.T) {
+	tree, err := Load(2, 1, mem.New(), countingRows(1, 100), 0.5)
+	require.Nil(t, err)
+
+	r := tree.GetRange(Inclusive(key(10)), Inclusive(key(20)))
+	for r.Next() {
+	}
+	require.True(t, r.Prev())
+	assert.Equal(t, domain.Word(20), r.This()[0])
+
+	for r.Prev() {
+	}
+	require.True(t, r.Next())
+	assert.Equal(t, domain.Word(10), r.This()[0])
+	require.True(t, r.Next())
+	assert.Equal(t, domain.Word(11), r.This()[0])
+}
+
+func TestRangeSeek(t *testing.T) {
+	store := mem.New()
+	var rows [][]domain.Word
+	for i := 1; i < 2000; i++ {
+		rows = append(rows, []domain.Word{domain.Word(i * 2), domain.Word(i)})
+	}
+	tree, err := Load(2, 1, store, newSliceRows(rows...), 0.5)
+	require.Nil(t, err)
+	require.Equal(t, 2, tree.Depth())
+
+	r := tree.GetRange(Inclusive(key(100)), Exclusive(key(3000)))
+	for _, test := range []struct {
+		seek, expected domain.Word
+		ok             bool
+	}{
+		{301, 302, true},
+		{302, 302, true},
+		{10, 100, true},
+		{2990, 2990, true},
+		{1500, 1500, true},
+		{2999, 0, false},
+		{4000, 0, false},
+		{640, 640, true},
+	} {
+		ok := r.Seek(key(test.seek))
+		require.Equal(t, test.ok, ok, "seek %d", test.seek)
+		if ok {
+			assert.Equal(t, test.expected, r.This()[0], "seek %d", test.seek)
+			require.True(t, r.Next())
+			assert.Equal(t, test.expected+2, r.This()[0], "seek %d", test.seek)
+		}
+	}
+	require.Nil(t, r.Err())
+}
+
+func TestScan(t *testing.T) {
+	const top = ^domain.Word(0)
+
+	var rows [][]domain.Word
+	for _, p := range []domain.Word{1, 2, 3, 7, top} {
+		for c := domain.Word(1); c <= 30; c++ {
+			rows = append(rows, []domain.Word{p, c, p + c})
+		}
+	}
+	tree, err := Load(3, 2, mem.New(), newSliceRows(rows...), 0.5)
+	require.Nil(t, err)
+
+	count := func(prefix ...domain.Word) int {
+		r := tree.Scan(prefix)
+		n := 0
+		for r.Next() {
+			row := r.This()
+			assert.Equal(t, prefix, append([]domain.Word(nil), row[:len(prefix)]...))
+			n++
+		}
+		require.Nil(t, r.Err())
+		return n
+	}
+
+	assert.Equal(t, 151, count())
+	assert.Equal(t, 30, count(2))
+	assert.Equal(t, 30, count(top))
+	assert.Equal(t, 0, count(5))
+	assert.Equal(t, 1, count(7, 12))
+	assert.Equal(t, 1, count(top, 30))
+	assert.Equal(t, 0, count(7, 31))
+
+	r := tree.Scan([]domain.Word{1, 2, 3})
+	assert.False(t, r.Next())
+	assert.True(t, errors.Is(r.Err(), ErrKeyWidth))
+}
@@ -0,0 +1,111 @@
+package tree
+
+import "github.com/catlev/pkg/domain"
+
+// A Join pairs up the entries of two ranges whose keys start with the same values, in key order.
+// Each range is skipped forward with Seek past entries that have no partner, so a join of a small
+// range with a large one touches little of the large one.
+type Join struct {
+	left, right *Range
+	n           int
+	started     bool
+	// the ranges are on entries not yet joined, where set
+	haveLeft, haveRight bool
+	// the entries of right with the key prefix being joined, and the left entry being paired with them
+	group [][]domain.Word
+	row   []domain.Word
+	pos   int
+	err   error
+}
+
+// MergeJoin gives a join of the entries of left and right whose keys agree on their first n
+// values. Both ranges must be unpositioned, and the trees under them ordered the same way on those
+// values. Where several entries on each side share a prefix, every pairing of them is given.
+func MergeJoin(left, right *Range, n int) *Join {
+	j := &Join{left: left, right: right, n: n}
+	if n < 1 || n > left.tree.key || n > right.tree.key {
+		j.err = &TreeError{Op: "MergeJoin", Err: ErrKeyWidth}
+	}
+	return j
+}
+
+// Next moves to the next pair of entries, reporting whether there is one.
+func (j *Join) Next() bool {
+	if j.err != nil {
+		return false
+	}
+	if !j.started {
+		j.started = true
+		j.haveLeft, j.haveRight = j.left.Next(), j.right.Next()
+	}
+
+	if j.group != nil {
+		j.pos++
+		if j.pos < len(j.group) {
+			return true
+		}
+		// the next entry of left may share the prefix too
+		j.haveLeft = j.left.Next()
+		if j.haveLeft && j.compare(j.left.This(), j.group[0]) == 0 {
+			j.row = append(j.row[:0], j.left.This()...)
+			j.pos = 0
+			return true
+		}
+		j.group = nil
+	}
+
+	for j.haveLeft && j.haveRight {
+		l, r := j.left.This(), j.right.This()
+		switch c := j.compare(l, r); {
+		case c > 0:
+			j.haveLeft = j.left.Seek(r[:j.n])
+		case c < 0:
+			j.haveRight = j.right.Seek(l[:j.n])
+		default:
+			j.row = append(j.row[:0], l...)
+			j.collect()
+			j.pos = 0
+			return true
+		}
+	}
+
+	return j.fail()
+}
+
+// collect gathers the entries of right that share the prefix of the one it is on, leaving it on
+// the first entry after them.
+func (j *Join) collect() {
+	first := append([]domain.Word(nil), j.right.This()...)
+	j.group = [][]domain.Word{first}
+	for j.haveRight = j.right.Next(); j.haveRight; j.haveRight = j.right.Next() {
+		if compareValues(j.right.This()[:j.n], first[:j.n]) != 0 {
+			break
+		}
+		j.group = append(j.group, append([]domain.Word(nil), j.right.This()...))
+	}
+}
+
+// fail notes any error that stopped either range.
+func (j *Join) fail() bool {
+	if err := j.left.Err(); err != nil {
+		j.err = err
+	} else if err := j.right.Err(); err != nil {
+		j.err = err
+	}
+	return false
+}
+
+// compare orders an entry of left and one of right by their key prefixes.
+func (j *Join) compare(a, b []domain.Word) int {
+	t, u := j.left.tree, j.right.tree
+	return t.order.compare(t.encodeKey(a[:j.n]), u.encodeKey(b[:j.n]))
+}
+
+// This gives the pair of entries the join is on.
+func (j *Join) This() (left, right []domain.Word) {
+	return j.row, j.group[j.pos]
+}
+
+func (j *Join) Err() error {
+	return j.err
+}
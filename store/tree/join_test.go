@@ -0,0 +1,93 @@
+package tree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeJoin(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	store := mem.New()
+
+	newTree := func(opts ...Option) *Tree {
+		start, _ := store.AddBlock(&domain.Block{})
+		return New(3, 2, store, 0, start, opts...)
+	}
+
+	for _, opts := range [][]Option{nil, {Collate(Signed)}} {
+		left, right := newTree(opts...), newTree(opts...)
+		for i := 0; i < 3000; i++ {
+			k := []domain.Word{domain.Word(rng.Intn(400)) - 200, domain.Word(rng.Intn(5)) + 1}
+			if rng.Intn(2) == 0 {
+				row := []domain.Word{k[0], k[1], 1}
+				require.Nil(t, left.Put(row))
+			} else {
+				row := []domain.Word{k[0] * 3, k[1], 2}
+				require.Nil(t, right.Put(row))
+			}
+		}
+
+		var want [][2][]domain.Word
+		collect := func(tr *Tree) [][]domain.Word {
+			var rows [][]domain.Word
+			r := tr.GetRange(Bound{}, Bound{})
+			for r.Next() {
+				rows = append(rows, append([]domain.Word(nil), r.This()...))
+			}
+			return rows
+		}
+		for _, l := range collect(left) {
+			for _, r := range collect(right) {
+				if l[0] == r[0] {
+					want = append(want, [2][]domain.Word{l, r})
+				}
+			}
+		}
+
+		j := MergeJoin(left.GetRange(Bound{}, Bound{}), right.GetRange(Bound{}, Bound{}), 1)
+		var got [][2][]domain.Word
+		for j.Next() {
+			l, r := j.This()
+			got = append(got, [2][]domain.Word{append([]domain.Word(nil), l...), r})
+		}
+		require.Nil(t, j.Err())
+		assert.Equal(t, want, got)
+	}
+}
+
+func TestMergeJoinSkips(t *testing.T) {
+	var big, small [][]domain.Word
+	for k := domain.Word(1); k <= 20000; k++ {
+		big = append(big, []domain.Word{k, k})
+	}
+	for k := domain.Word(1000); k <= 20000; k += 1000 {
+		small = append(small, []domain.Word{k, 0})
+	}
+
+	store := &readCountingStore{Store: mem.New()}
+	bigTree, err := Load(2, 1, store, newSliceRows(big...), 1)
+	require.Nil(t, err)
+	smallTree, err := Load(2, 1, store, newSliceRows(small...), 1)
+	require.Nil(t, err)
+
+	store.reads = 0
+	j := MergeJoin(smallTree.GetRange(Exclusive([]domain.Word{0}), Bound{}), bigTree.GetRange(Bound{}, Bound{}), 1)
+	var keys []domain.Word
+	for j.Next() {
+		l, r := j.This()
+		assert.Equal(t, l[0], r[1])
+		keys = append(keys, l[0])
+	}
+	require.Nil(t, j.Err())
+	assert.Len(t, keys, 20)
+	assert.Less(t, store.reads, 100)
+
+	j = MergeJoin(smallTree.GetRange(Bound{}, Bound{}), bigTree.GetRange(Bound{}, Bound{}), 2)
+	assert.False(t, j.Next())
+	assert.ErrorIs(t, j.Err(), ErrKeyWidth)
+}
@@ -0,0 +1,206 @@
+package tree
+
+import "github.com/catlev/pkg/domain"
+
+// Rows is a source of rows, such as a Range.
+type Rows interface {
+	Next() bool
+	This() []domain.Word
+	Err() error
+}
+
+type loader struct {
+	tree   *Tree
+	fill   float64
+	levels []*loadLevel
+}
+
+// Each level holds back one full node, so that the last node on the level can be balanced against
+// it before either is written.
+type loadLevel struct {
+	pending, current *node
+}
+
+// Load builds a tree bottom-up from rows, which must be sorted by key with no key repeated. Each
+// node is packed to the given fill factor, the fraction of its capacity to use, and written once
+// through AddBlock. As with a tree grown from an empty block, the result holds a row for the zero
+// key. Errors may also originate from rows or from the block store.
+func Load(columns, key int, store domain.Store, rows Rows, fill float64, opts ...Option) (t *Tree, err error) {
+	var last []domain.Word
+	defer func() {
+		wrapErr(&err, "Load", last)
+	}()
+
+	t = New(columns, key, store, 0, 0, opts...)
+	l := &loader{tree: t, fill: fill}
+
+	for rows.Next() {
+		row := rows.This()
+		if len(row) != columns {
+			return nil, ErrBadRow
+		}
+		row = t.encodeRow(row)
+		if last == nil && compareValues(row[:key], make([]domain.Word, key)) != 0 {
+			// the leftmost row of the tree is expected to have the zero key
+			err = l.add(0, make([]domain.Word, t.leafColumns()))
+		} else if last != nil && t.order.compare(last, row[:key]) <= 0 {
+			err = ErrUnsorted
+		}
+		if err != nil {
+			return nil, err
+		}
+		last = append(last[:0], row[:key]...)
+
+		row, err = t.storeRow(row)
+		if err != nil {
+			return nil, err
+		}
+		err = l.add(0, row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		err = l.add(0, make([]domain.Word, t.leafColumns()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	last = nil
+	err = l.finish()
+	if err != nil {
+		return nil, err
+	}
+	err = t.publishChanges()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (l *loader) add(level int, row []domain.Word) error {
+	if level == len(l.levels) {
+		l.levels = append(l.levels, &loadLevel{})
+	}
+	lv := l.levels[level]
+
+	if lv.current == nil {
+		lv.current = l.newNode(level)
+	}
+	lv.current.insert(lv.current.width, row)
+	if !l.over(lv.current) {
+		return nil
+	}
+
+	// the row belongs in the next node instead
+	lv.current.remove(lv.current.width-1, 1)
+	if lv.pending != nil {
+		err := l.emit(level, lv.pending)
+		if err != nil {
+			return err
+		}
+	}
+	lv.pending, lv.current = lv.current, l.newNode(level)
+	lv.current.insert(0, row)
+	return nil
+}
+
+func (l *loader) finish() error {
+	for level := 0; level < len(l.levels); level++ {
+		lv := l.levels[level]
+
+		if level == len(l.levels)-1 && lv.pending == nil {
+			// a lone node on the top level is the root
+			b, err := lv.current.encode()
+			if err != nil {
+				return err
+			}
+			id, err := l.tree.addBlock(b)
+			if err != nil {
+				return err
+			}
+			l.tree.root = id
+			l.tree.depth = level
+			return nil
+		}
+
+		err := l.balance(level, lv)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range []*node{lv.pending, lv.current} {
+			if n == nil {
+				continue
+			}
+			err := l.emit(level, n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *loader) balance(level int, lv *loadLevel) error {
+	if lv.pending == nil || lv.current.width >= lv.current.minWidth() {
+		return nil
+	}
+
+	left := l.newNode(level)
+	for _, n := range []*node{lv.pending, lv.current} {
+		left.insert(left.width, n.getRows(0, n.width)...)
+	}
+	if left.fits() {
+		lv.pending, lv.current = nil, left
+		return nil
+	}
+
+	at, err := left.splitPoint()
+	if err != nil {
+		return err
+	}
+	right := l.newNode(level)
+	right.insert(0, left.getRows(at, left.width)...)
+	left.remove(at, left.width-at)
+	lv.pending, lv.current = left, right
+	return nil
+}
+
+func (l *loader) emit(level int, n *node) error {
+	b, err := n.encode()
+	if err != nil {
+		return err
+	}
+	id, err := l.tree.addBlock(b)
+	if err != nil {
+		return err
+	}
+
+	n.id = id
+
+	return l.add(level+1, l.tree.entry(n.getRow(0)[:l.tree.key], n))
+}
+
+func (l *loader) newNode(level int) *node {
+	return l.tree.newNode(level == 0)
+}
+
+// over reports whether n holds more than the fill factor allows, or more than fits in a block.
+func (l *loader) over(n *node) bool {
+	if !n.fits() {
+		return true
+	}
+	if n.width <= max(n.minWidth(), 1) {
+		return false
+	}
+	room := n.maxWidth() * n.columns
+	if n.compress {
+		room = domain.WordSize
+	}
+	return float64(n.sizeOf(0, n.width)) > l.fill*float64(room)
+}
@@ -0,0 +1,96 @@
+package tree
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sliceRows struct {
+	rows [][]domain.Word
+	pos  int
+}
+
+func newSliceRows(rows ...[]domain.Word) *sliceRows {
+	return &sliceRows{rows: rows, pos: -1}
+}
+
+func (r *sliceRows) Next() bool {
+	r.pos++
+	return r.pos < len(r.rows)
+}
+
+func (r *sliceRows) This() []domain.Word {
+	return r.rows[r.pos]
+}
+
+func (r *sliceRows) Err() error {
+	return nil
+}
+
+func countingRows(from, to int) *sliceRows {
+	var rows [][]domain.Word
+	for i := from; i < to; i++ {
+		rows = append(rows, []domain.Word{domain.Word(i), domain.Word((i / 10) + 1)})
+	}
+	return newSliceRows(rows...)
+}
+
+func TestLoad(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		fill  float64
+		depth int
+	}{
+		{"Full", 1, 1},
+		{"Half", 0.5, 2},
+		{"Mostly", 0.8, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tree, err := Load(2, 1, mem.New(), countingRows(1, 1000), test.fill)
+			require.Nil(t, err)
+
+			assert.Equal(t, test.depth, tree.Depth())
+
+			for i := 1; i < 1000; i++ {
+				assertTreeProperty(t, i, getRow(t, tree, []domain.Word{domain.Word(i)})[1])
+			}
+		})
+	}
+}
+
+func TestLoadThenPut(t *testing.T) {
+	tree, err := Load(2, 1, mem.New(), countingRows(0, 500), 1)
+	require.Nil(t, err)
+
+	for i := 500; i < 1000; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), domain.Word((i / 10) + 1)}))
+	}
+	for i := 0; i < 1000; i++ {
+		assertTreeProperty(t, i, getRow(t, tree, []domain.Word{domain.Word(i)})[1])
+	}
+}
+
+func TestLoadEmpty(t *testing.T) {
+	tree, err := Load(2, 1, mem.New(), newSliceRows(), 1)
+	require.Nil(t, err)
+
+	assert.Equal(t, 0, tree.Depth())
+	require.Nil(t, tree.Put([]domain.Word{4, 5}))
+	assert.Equal(t, domain.Word(5), getRow(t, tree, []domain.Word{4})[1])
+}
+
+func TestLoadBadRows(t *testing.T) {
+	_, err := Load(2, 1, mem.New(), newSliceRows([]domain.Word{1, 2, 3}), 1)
+	assert.True(t, errors.Is(err, ErrBadRow))
+
+	_, err = Load(2, 1, mem.New(), newSliceRows([]domain.Word{2, 2}, []domain.Word{1, 2}), 1)
+	assert.True(t, errors.Is(err, ErrUnsorted))
+
+	_, err = Load(2, 1, mem.New(), newSliceRows([]domain.Word{2, 2}, []domain.Word{2, 3}), 1)
+	assert.True(t, errors.Is(err, ErrUnsorted))
+}
@@ -0,0 +1,103 @@
+package tree
+
+import "github.com/catlev/pkg/domain"
+
+// With the Overflow option, rows keep their non-key columns in a chain of overflow blocks, and the
+// leaf holds only the key and the id of the first block in the chain. Each block in the chain
+// starts with the id of the next, or 0 at the end of the chain. A row whose non-key columns are all
+// zero has no chain.
+
+const overflowSize = domain.WordSize - 1
+
+func (t *Tree) leafColumns() int {
+	if t.overflow {
+		return t.key + 1
+	}
+	return t.columns
+}
+
+// storeRow gives the form of row to be kept in a leaf, writing out its overflow chain if it has one.
+func (t *Tree) storeRow(row []domain.Word) ([]domain.Word, error) {
+	if !t.overflow {
+		return row, nil
+	}
+
+	stored := make([]domain.Word, t.key+1)
+	copy(stored, row[:t.key])
+
+	values := row[t.key:]
+	for len(values) > 0 && values[len(values)-1] == 0 {
+		values = values[:len(values)-1]
+	}
+
+	// write the chain back to front, so that each block knows its successor
+	var next domain.Word
+	for i := (len(values) - 1) / overflowSize; i >= 0 && len(values) > 0; i-- {
+		var b domain.Block
+		b[0] = next
+		copy(b[1:], values[i*overflowSize:])
+
+		id, err := t.addChain(&b)
+		if err != nil {
+			return nil, err
+		}
+		next = id
+	}
+	stored[t.key] = next
+
+	return stored, nil
+}
+
+// addChain gives a block of an overflow chain a block of its own, or keeps it in staging while a
+// batch is applied.
+func (t *Tree) addChain(b *domain.Block) (domain.Word, error) {
+	if t.staging != nil {
+		return t.staging.stageChain(b), nil
+	}
+	return t.addBlock(b)
+}
+
+// loadRow reassembles a row from the form kept in a leaf.
+func (t *Tree) loadRow(stored []domain.Word) ([]domain.Word, error) {
+	if !t.overflow {
+		return stored, nil
+	}
+
+	row := make([]domain.Word, t.columns)
+	copy(row, stored[:t.key])
+
+	values := row[t.key:]
+	for id := stored[t.key]; id != 0 && len(values) > 0; values = values[min(len(values), overflowSize):] {
+		var b domain.Block
+		err := t.readBlock(id, &b)
+		if err != nil {
+			return nil, err
+		}
+		copy(values, b[1:])
+		id = b[0]
+	}
+
+	return row, nil
+}
+
+// freeRow releases the overflow chain of a row that has been removed from a leaf.
+func (t *Tree) freeRow(stored []domain.Word) error {
+	if !t.overflow {
+		return nil
+	}
+
+	for id := stored[t.key]; id != 0; {
+		var b domain.Block
+		err := t.readBlock(id, &b)
+		if err != nil {
+			return err
+		}
+		err = t.freeBlock(id)
+		if err != nil {
+			return err
+		}
+		id = b[0]
+	}
+
+	return nil
+}
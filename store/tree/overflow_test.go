@@ -0,0 +1,86 @@
+package tree
+
+import (
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStore struct {
+	mem.Store
+	live int
+}
+
+func (s *countingStore) AddBlock(b *domain.Block) (domain.Word, error) {
+	s.live++
+	return s.Store.AddBlock(b)
+}
+
+func (s *countingStore) FreeBlock(id domain.Word) error {
+	s.live--
+	return s.Store.FreeBlock(id)
+}
+
+func wideRow(k domain.Word, columns int) []domain.Word {
+	row := make([]domain.Word, columns)
+	row[0] = k
+	for i := 1; i < columns; i++ {
+		row[i] = k*1000 + domain.Word(i)
+	}
+	return row
+}
+
+func TestOverflow(t *testing.T) {
+	for _, columns := range []int{17, 64, 200} {
+		store := &countingStore{Store: *mem.New()}
+		start, _ := store.AddBlock(&domain.Block{})
+		tree := New(columns, 1, store, 0, start, Overflow())
+
+		for k := domain.Word(1); k <= 100; k++ {
+			require.Nil(t, tree.Put(wideRow(k, columns)))
+		}
+		assertSound(t, tree)
+
+		for k := domain.Word(1); k <= 100; k++ {
+			assert.Equal(t, wideRow(k, columns), getRow(t, tree, []domain.Word{k}))
+		}
+
+		r := tree.GetRange(Exclusive([]domain.Word{0}), Bound{})
+		for k := domain.Word(1); r.Next(); k++ {
+			assert.Equal(t, wideRow(k, columns), r.This())
+		}
+		require.Nil(t, r.Err())
+
+		updated := wideRow(50, columns)
+		updated[columns-1] = 7
+		require.Nil(t, tree.Put(updated))
+		assert.Equal(t, updated, getRow(t, tree, []domain.Word{50}))
+
+		for k := domain.Word(1); k <= 100; k++ {
+			require.Nil(t, tree.Delete([]domain.Word{k}))
+		}
+		assertSound(t, tree)
+
+		// only the root is left, and every overflow chain has been released
+		assert.Equal(t, 1, store.live)
+	}
+}
+
+func TestLoadOverflow(t *testing.T) {
+	var rows [][]domain.Word
+	for k := domain.Word(1); k <= 100; k++ {
+		rows = append(rows, wideRow(k, 30))
+	}
+
+	tree, err := Load(30, 1, mem.New(), newSliceRows(rows...), 1, Overflow())
+	require.Nil(t, err)
+	assertSound(t, tree)
+
+	for k := domain.Word(1); k <= 100; k++ {
+		assert.Equal(t, wideRow(k, 30), getRow(t, tree, []domain.Word{k}))
+	}
+	assert.Equal(t, make([]domain.Word, 30), getRow(t, tree, []domain.Word{0}))
+}
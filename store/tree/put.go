@@ -15,58 +15,103 @@ func (t *Tree) Put(row []domain.Word) (err error) {
 
 	defer wrapErr(&err, "Put", key)
 
-	n, err := t.findNode(key)
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	t.beginWrite()
+	defer t.endWrite(&err)
+
+	return t.put(t.encodeRow(row))
+}
+
+func (t *Tree) put(row []domain.Word) error {
+	n, idx, found, err := t.locate(row[:t.key])
 	if err != nil {
 		return err
 	}
+	return t.putAt(n, idx, found, row)
+}
 
-	idx := n.probe(key)
+// locate finds the leaf that key belongs in, and the index of the row for it, or of the row it
+// would follow if it isn't there.
+func (t *Tree) locate(key []domain.Word) (n *node, idx int, found bool, err error) {
+	n, err = t.findNode(t.working(), key)
+	if err != nil {
+		return nil, 0, false, err
+	}
 
-	if compareValues(n.getRow(idx), row) == 0 {
-		// no update required
-		return nil
+	idx = n.probe(key)
+	return n, idx, n.compareKeyAt(idx, key) == 0, nil
+}
+
+// putAt puts row in the leaf n, where locate found its key.
+func (t *Tree) putAt(n *node, idx int, found bool, row []domain.Word) error {
+	if found {
+		return t.updateRow(n, idx, row)
 	}
 
-	if n.compareKeyAt(idx, key) == 0 {
-		// updating existing entry, no need to make room
-		copy(n.entries[idx*n.columns:], row)
-		return t.writeNode(n)
+	stored, err := t.storeRow(row)
+	if err != nil {
+		return err
 	}
 
-	_, err = t.addNodeEntry(n, key, row)
+	_, err = t.addNodeEntry(n, row[:t.key], stored)
 	return err
 }
 
-func (t *Tree) addNodeEntry(n *node, key []domain.Word, r []domain.Word) (*node, error) {
-	var err error
+// updateRow replaces the row at idx in the leaf n, which has the same key.
+func (t *Tree) updateRow(n *node, idx int, row []domain.Word) error {
+	prev := append([]domain.Word(nil), n.getRow(idx)...)
+	changed, err := t.replaceRow(n, idx, row)
+	if err != nil || !changed {
+		return err
+	}
 
-	if n == nil {
-		rootNode := &node{
-			columns: t.key + 1,
-			key:     t.key,
-		}
-		rootNode.entries[t.key] = t.root
-		copy(rootNode.entries[t.key+1:], r)
+	err = t.writeNode(n)
+	if err != nil {
+		return err
+	}
 
-		rootNode.id, err = t.store.AddBlock(rootNode.entriesAsBlock())
-		if err != nil {
-			return nil, err
-		}
+	return t.freeRow(prev)
+}
 
-		t.root = rootNode.id
-		t.depth++
-		return rootNode, nil
+// replaceRow replaces the row at idx in the leaf n with row, which has the same key, without writing
+// n or freeing what the old row kept outside of it. It reports whether the row has changed.
+func (t *Tree) replaceRow(n *node, idx int, row []domain.Word) (bool, error) {
+	old, err := t.loadRow(n.getRow(idx))
+	if err != nil {
+		return false, err
+	}
+	if compareValues(old, row) == 0 {
+		// no update required
+		return false, nil
 	}
 
-	if n.width == n.maxWidth() {
-		// out of room in this node, so split (and update ancestors)
-		n, err = t.splitNode(n, key)
-		if err != nil {
-			return nil, err
-		}
+	stored, err := t.storeRow(row)
+	if err != nil {
+		return false, err
+	}
+
+	// updating existing entry, no need to make room
+	copy(n.getRow(idx), stored)
+	return true, nil
+}
+
+func (t *Tree) addNodeEntry(n *node, key []domain.Word, r []domain.Word) (*node, error) {
+	var err error
+
+	idx := n.probe(key)
+	if n.compareKeyAt(idx, key) >= 0 {
+		// the first row of a leaf may hold a key above the one that led to the leaf
+		idx++
 	}
+	n.insert(idx, r)
 
-	n.insert(n.probe(key)+1, r)
+	if !n.fits() {
+		// out of room in this node, so split (and update ancestors)
+		return t.splitNode(n, key)
+	}
 
 	err = t.writeNode(n)
 	if err != nil {
@@ -75,19 +120,22 @@ func (t *Tree) addNodeEntry(n *node, key []domain.Word, r []domain.Word) (*node,
 	return n, nil
 }
 
+// splitNode moves the upper rows of n, which has outgrown its block, to a new sibling. It returns
+// whichever of the two now holds key.
 func (t *Tree) splitNode(n *node, key []domain.Word) (*node, error) {
-	midpoint := make([]domain.Word, t.key)
-	copy(midpoint, n.getKey(n.minWidth()))
-
-	newNode := &node{
-		columns: n.columns,
-		key:     n.key,
+	at, err := n.splitPoint()
+	if err != nil {
+		return nil, err
 	}
-	newNode.insert(0, n.getRows(n.minWidth(), n.maxWidth())...)
 
-	n.clearRows(n.minWidth(), -1)
+	midpoint := make([]domain.Word, t.key)
+	copy(midpoint, n.getKey(at))
+
+	newNode := t.newNode(n.leaf)
+	newNode.insert(0, n.getRows(at, n.width)...)
+	n.remove(at, n.width-at)
 
-	id, err := t.store.AddBlock(newNode.entriesAsBlock())
+	err = t.addNode(newNode)
 	if err != nil {
 		return nil, err
 	}
@@ -97,29 +145,38 @@ func (t *Tree) splitNode(n *node, key []domain.Word) (*node, error) {
 		return nil, err
 	}
 
-	row := make([]domain.Word, t.key+1)
-	copy(row, midpoint)
-	row[t.key] = id
-
-	n.parent, err = t.addNodeEntry(n.parent, midpoint, row)
+	var parent *node
+	if n.parent == nil {
+		parent, err = t.newRoot(n, t.entry(midpoint, newNode))
+	} else {
+		parent, err = t.addNodeEntry(n.parent, midpoint, t.entry(midpoint, newNode))
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if compareValues(midpoint, key) > 0 {
-		newNode.parent = n.parent
-		newNode.pos = 1
-		newNode.id = id
+	// the parent may have been split in turn, so find both halves again
+	pos := parent.probe(midpoint)
+	n.parent, n.pos = parent, pos-1
+	newNode.parent, newNode.pos = parent, pos
+
+	if t.order.compare(midpoint, key) >= 0 {
 		return newNode, nil
 	}
+	return n, nil
+}
+
+// newRoot adds a level to the tree, with a root over the old root and the given row.
+func (t *Tree) newRoot(old *node, r []domain.Word) (*node, error) {
+	rootNode := t.newNode(false)
+	rootNode.insert(0, t.entry(nil, old), r)
+
+	err := t.addNode(rootNode)
+	if err != nil {
+		return nil, err
+	}
 
-	return &node{
-		columns: n.columns,
-		key:     n.key,
-		parent:  n.parent,
-		id:      n.id,
-		pos:     0,
-		entries: n.entries,
-		width:   n.minWidth(),
-	}, nil
+	t.root = rootNode.id
+	t.depth++
+	return rootNode, nil
 }
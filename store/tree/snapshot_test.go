@@ -0,0 +1,69 @@
+package tree
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyOnWriteNewRoot(t *testing.T) {
+	store := mem.New()
+	d1, _ := store.AddBlock(&domain.Block{0, 1, 10, 2, 20, 3})
+	d2, _ := store.AddBlock(&domain.Block{0, 4, 40, 5, 50, 6})
+	start, _ := store.AddBlock(&domain.Block{0, d1, 30, d2})
+	tree := New(2, 1, store, 1, start, CopyOnWrite())
+
+	tree.Put([]domain.Word{20, 7})
+
+	assert.NotEqual(t, start, tree.Root())
+	assert.Equal(t, domain.Word(7), getRow(t, tree, []domain.Word{20})[1])
+	assert.Equal(t, domain.Word(3), getRow(t, New(2, 1, store, 1, start), []domain.Word{20})[1])
+
+	// without an intervening snapshot, the new blocks are private to the writer
+	root := tree.Root()
+	tree.Put([]domain.Word{40, 8})
+
+	assert.Equal(t, root, tree.Root())
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start, CopyOnWrite())
+
+	for i := 1; i < 200; i++ {
+		tree.Put([]domain.Word{domain.Word(i), domain.Word(i)})
+	}
+
+	snap := tree.Snapshot()
+
+	for i := 1; i < 400; i++ {
+		tree.Put([]domain.Word{domain.Word(i), domain.Word(i * 2)})
+	}
+	for i := 1; i < 50; i++ {
+		tree.Delete([]domain.Word{domain.Word(i * 4)})
+	}
+
+	for i := 1; i < 200; i++ {
+		assert.Equal(t, domain.Word(i), getRow(t, snap, []domain.Word{domain.Word(i)})[1])
+	}
+	_, err := snap.Get([]domain.Word{300})
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	for i := 200; i < 400; i++ {
+		assert.Equal(t, domain.Word(i*2), getRow(t, tree, []domain.Word{domain.Word(i)})[1])
+	}
+}
+
+func TestSnapshotReadOnly(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start, CopyOnWrite())
+	snap := tree.Snapshot()
+
+	assert.True(t, errors.Is(snap.Put([]domain.Word{1, 2}), ErrReadOnly))
+	assert.True(t, errors.Is(snap.Delete([]domain.Word{1}), ErrReadOnly))
+}
@@ -0,0 +1,152 @@
+package tree
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// statsSample is the number of rows that Stats looks at to estimate the number of distinct
+// values in each column.
+const statsSample = 1024
+
+// Stats describes the shape of a tree and the rows it holds.
+type Stats struct {
+	Rows  int
+	Depth int
+	// Nodes counts the nodes at each level, starting from the leaves at level 0.
+	Nodes []int
+	// Fill is the average fraction of its block that a node uses.
+	Fill float64
+	// Free is the number of words left unused across the blocks of all nodes.
+	Free int
+	// Distinct estimates the number of distinct values in each column, from a sample of the rows.
+	Distinct []float64
+}
+
+type statsWalker struct {
+	tree   *Tree
+	stats  *Stats
+	used   int
+	rng    *rand.Rand
+	sample [][]domain.Word
+}
+
+// Stats walks every node of the tree to describe it. Errors may originate from the block store.
+func (t *Tree) Stats() (s *Stats, err error) {
+	defer wrapErr(&err, "Stats", nil)
+
+	cur := t.beginRead()
+	defer t.endRead()
+
+	root, err := t.readNode(cur.depth == 0, nil, 0, cur.root)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &statsWalker{
+		tree: t,
+		stats: &Stats{
+			Depth: cur.depth,
+			Nodes: make([]int, cur.depth+1),
+		},
+		// the same tree always gives the same estimates
+		rng: rand.New(rand.NewSource(1)),
+	}
+	err = w.visit(root, cur.depth)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := 0
+	for _, c := range w.stats.Nodes {
+		nodes += c
+	}
+	w.stats.Fill = float64(w.used) / float64(nodes*domain.WordSize)
+	w.stats.Free = nodes*domain.WordSize - w.used
+
+	w.stats.Distinct, err = w.distinct()
+	if err != nil {
+		return nil, err
+	}
+	return w.stats, nil
+}
+
+func (w *statsWalker) visit(n *node, level int) error {
+	w.stats.Nodes[level]++
+	w.used += n.sizeOf(0, n.width)
+
+	if n.leaf {
+		for i := 0; i < n.width; i++ {
+			w.add(n.getRow(i))
+		}
+		return nil
+	}
+
+	for i := 0; i < n.width; i++ {
+		child, err := w.tree.followNode(level == 1, n, i)
+		if err != nil {
+			return err
+		}
+		err = w.visit(child, level-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add counts a row, and keeps it in a sample drawn uniformly from the rows seen so far.
+func (w *statsWalker) add(row []domain.Word) {
+	w.stats.Rows++
+
+	if len(w.sample) < statsSample {
+		w.sample = append(w.sample, append([]domain.Word(nil), row...))
+		return
+	}
+	if i := w.rng.Intn(w.stats.Rows); i < statsSample {
+		w.sample[i] = append(w.sample[i][:0], row...)
+	}
+}
+
+// distinct estimates the number of distinct values in each column. A column whose values are all
+// different in the sample is taken to be unique. Otherwise the estimate is GEE's, which scales up
+// the values seen once in the sample and takes the rest as they are.
+func (w *statsWalker) distinct() ([]float64, error) {
+	counts := make([]map[domain.Word]int, w.tree.columns)
+	for i := range counts {
+		counts[i] = map[domain.Word]int{}
+	}
+
+	for _, stored := range w.sample {
+		row, err := w.tree.loadRow(stored)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			counts[i][v]++
+		}
+	}
+
+	scale := 1.0
+	if len(w.sample) > 0 {
+		scale = math.Sqrt(float64(w.stats.Rows) / float64(len(w.sample)))
+	}
+
+	estimates := make([]float64, w.tree.columns)
+	for i, c := range counts {
+		once := 0
+		for _, k := range c {
+			if k == 1 {
+				once++
+			}
+		}
+		if once == len(w.sample) || i == 0 && w.tree.key == 1 {
+			estimates[i] = float64(w.stats.Rows)
+			continue
+		}
+		estimates[i] = math.Min(scale*float64(once)+float64(len(c)-once), float64(w.stats.Rows))
+	}
+	return estimates, nil
+}
@@ -0,0 +1,79 @@
+package tree
+
+import (
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsSmall(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(3, 1, store, 0, start)
+	for i := 1; i <= 500; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), domain.Word(i % 10), 7}))
+	}
+
+	stats, err := tree.Stats()
+	require.Nil(t, err)
+
+	// the zero key is always present
+	assert.Equal(t, 501, stats.Rows)
+	assert.Equal(t, tree.Depth(), stats.Depth)
+	assert.Len(t, stats.Nodes, stats.Depth+1)
+	assert.Equal(t, 1, stats.Nodes[stats.Depth])
+	assert.Greater(t, stats.Fill, 0.5)
+	assert.LessOrEqual(t, stats.Fill, 1.0)
+
+	nodes := 0
+	for _, c := range stats.Nodes {
+		nodes += c
+	}
+	assert.InDelta(t, float64(stats.Free)/float64(nodes*domain.WordSize), 1-stats.Fill, 1e-9)
+
+	// every row is in the sample, so the estimates are exact
+	assert.Equal(t, []float64{501, 10, 2}, stats.Distinct)
+}
+
+func TestStatsSampled(t *testing.T) {
+	rows := make([][]domain.Word, 20000)
+	for i := range rows {
+		rows[i] = []domain.Word{domain.Word(i / 100), domain.Word(i % 100), domain.Word(i % 50), domain.Word(i)}
+	}
+	tree, err := Load(4, 2, mem.New(), newSliceRows(rows...), 1)
+	require.Nil(t, err)
+
+	stats, err := tree.Stats()
+	require.Nil(t, err)
+
+	assert.Equal(t, 20000, stats.Rows)
+	assert.InEpsilon(t, 200, stats.Distinct[0], 0.25)
+	assert.InEpsilon(t, 100, stats.Distinct[1], 0.1)
+	assert.InEpsilon(t, 50, stats.Distinct[2], 0.1)
+	assert.InEpsilon(t, 20000, stats.Distinct[3], 0.1)
+}
+
+func TestStatsAfterDeletes(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start)
+	for i := 1; i <= 2000; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), 1}))
+	}
+	before, err := tree.Stats()
+	require.Nil(t, err)
+
+	for i := 1; i <= 2000; i++ {
+		if i%4 != 0 {
+			require.Nil(t, tree.Delete([]domain.Word{domain.Word(i)}))
+		}
+	}
+	after, err := tree.Stats()
+	require.Nil(t, err)
+
+	assert.Equal(t, 501, after.Rows)
+	assert.Less(t, after.Nodes[0], before.Nodes[0])
+}
@@ -0,0 +1,235 @@
+package tree
+
+import (
+	"fmt"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// A Problem is a structural defect that Verify found in a tree.
+type Problem struct {
+	Kind  ProblemKind
+	Block domain.Word
+	// Level counts up from the leaves, which are at level 0.
+	Level int
+	// Row is the index of the row the problem concerns, or -1 if it concerns the whole node.
+	Row int
+}
+
+type ProblemKind int
+
+const (
+	// The keys of a node are not in ascending order.
+	Unordered ProblemKind = iota + 1
+	// A node holds fewer rows than its minimum width, or more than fit in its block.
+	BadWidth
+	// A key lies outside the range given to its node by the separator keys above it.
+	BadSeparator
+	// A leaf lies above the bottom level of the tree, or an interior node at it. Nodes carry no
+	// marker of their level, so a node is taken to be a leaf when none of its rows name a block
+	// that reads as a node starting between the row's separators, and to be interior when every one
+	// of them names a block that reads as a sound node between them.
+	// The leaves of a tree with overflow chains name blocks too, so in such a tree an interior node
+	// at the bottom goes unnoticed.
+	BadDepth
+	// A block is reachable by more than one path from the root.
+	SharedBlock
+	// The count that a row of an interior node keeps differs from the number of rows under it.
+	BadCount
+	// A row of an interior node names a block that cannot be read as a node.
+	BadChild
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case Unordered:
+		return "keys out of order"
+	case BadWidth:
+		return "bad node width"
+	case BadSeparator:
+		return "key outside separators"
+	case BadDepth:
+		return "node at wrong depth"
+	case SharedBlock:
+		return "block reachable twice"
+	case BadCount:
+		return "wrong row count"
+	case BadChild:
+		return "unreadable child"
+	default:
+		return fmt.Sprintf("ProblemKind(%d)", int(k))
+	}
+}
+
+func (p Problem) String() string {
+	if p.Row < 0 {
+		return fmt.Sprintf("%s in block %d at level %d", p.Kind, p.Block, p.Level)
+	}
+	return fmt.Sprintf("%s in block %d at level %d, row %d", p.Kind, p.Block, p.Level, p.Row)
+}
+
+type verifier struct {
+	tree     *Tree
+	seen     map[domain.Word]bool
+	problems []Problem
+}
+
+// Verify walks every node of the tree and reports each structural problem it finds. An error is
+// only returned if the root of the tree cannot be read.
+func Verify(t *Tree) ([]Problem, error) {
+	cur := t.beginRead()
+	defer t.endRead()
+
+	root, err := t.readNode(cur.depth == 0, nil, 0, cur.root)
+	if err != nil {
+		return nil, &TreeError{Op: "Verify", Err: err}
+	}
+
+	v := &verifier{
+		tree: t,
+		seen: map[domain.Word]bool{},
+	}
+	v.visit(root, cur.depth, nil, nil)
+
+	return v.problems, nil
+}
+
+func (v *verifier) report(kind ProblemKind, n *node, level, row int) {
+	v.problems = append(v.problems, Problem{
+		Kind:  kind,
+		Block: n.id,
+		Level: level,
+		Row:   row,
+	})
+}
+
+// visit checks n and everything below it, and gives the number of rows found under it. Every key
+// in n should be no less than lo and less than hi, where a nil bound is open.
+func (v *verifier) visit(n *node, level int, lo, hi []domain.Word) domain.Word {
+	if v.seen[n.id] {
+		v.report(SharedBlock, n, level, -1)
+		return 0
+	}
+	v.seen[n.id] = true
+
+	readable, sound := v.children(n, level, lo, hi)
+	if level > 0 && readable == 0 || level == 0 && !v.tree.overflow && sound == n.width {
+		v.report(BadDepth, n, level, -1)
+		return 0
+	}
+
+	switch {
+	case !n.fits():
+		v.report(BadWidth, n, level, -1)
+	case n.parent != nil && n.width < n.minWidth():
+		v.report(BadWidth, n, level, -1)
+	case n.parent == nil && !n.leaf && n.width < 2:
+		v.report(BadWidth, n, level, -1)
+	}
+
+	first := 1
+	if n.leaf {
+		first = 0
+	}
+	for i := first; i < n.width; i++ {
+		key := n.getKey(i)
+		if i > first && n.order.compare(n.getKey(i-1), key) <= 0 {
+			v.report(Unordered, n, level, i)
+		}
+		if !between(n.order, key, lo, hi) {
+			v.report(BadSeparator, n, level, i)
+		}
+	}
+
+	if n.leaf {
+		return domain.Word(n.width)
+	}
+
+	var total domain.Word
+	for i := 0; i < n.width; i++ {
+		childLo, childHi := lo, hi
+		if i > 0 {
+			childLo = n.getKey(i)
+		}
+		if i+1 < n.width {
+			childHi = n.getKey(i + 1)
+		}
+
+		child, err := v.tree.followNode(level == 1, n, i)
+		if err != nil {
+			v.report(BadChild, n, level, i)
+			continue
+		}
+		count := v.visit(child, level-1, childLo, childHi)
+		if n.counted && n.getRow(i)[n.key+1] != count {
+			v.report(BadCount, n, level, i)
+		}
+		total += count
+	}
+	return total
+}
+
+// children looks at the rows of the block of n, found level levels above the leaves, as though it
+// were an interior node. It gives the number of rows naming a child that can be read and whose first
+// key lies between the row's separators, and of those, the number naming one that is sound.
+func (v *verifier) children(n *node, level int, lo, hi []domain.Word) (readable, sound int) {
+	t := v.tree
+	in, err := t.readNode(false, n.parent, n.pos, n.id)
+	if err != nil {
+		return 0, 0
+	}
+
+	for i := 0; i < in.width; i++ {
+		id := in.getRow(i)[t.key]
+		if id&stagedID != 0 {
+			continue
+		}
+		child, err := t.readNode(level <= 1, in, i, id)
+		if err != nil {
+			continue
+		}
+
+		childLo, childHi := lo, hi
+		if i > 0 {
+			childLo = in.getKey(i)
+		}
+		if i+1 < in.width {
+			childHi = in.getKey(i + 1)
+		}
+		if !between(child.order, child.getKey(0), childLo, childHi) {
+			continue
+		}
+		readable++
+		if isSound(child, childLo, childHi) {
+			sound++
+		}
+	}
+	return readable, sound
+}
+
+// isSound reports whether n fits in its block, is at least half full, and has its keys in order
+// and between lo and hi.
+func isSound(n *node, lo, hi []domain.Word) bool {
+	if !n.fits() || n.width < n.minWidth() {
+		return false
+	}
+	first := 1
+	if n.leaf {
+		first = 0
+	}
+	for i := first; i < n.width; i++ {
+		key := n.getKey(i)
+		if i > first && n.order.compare(n.getKey(i-1), key) <= 0 {
+			return false
+		}
+		if !between(n.order, key, lo, hi) {
+			return false
+		}
+	}
+	return true
+}
+
+// between reports whether key is no less than lo and less than hi, where a nil bound is open.
+func between(o order, key, lo, hi []domain.Word) bool {
+	return (lo == nil || o.compare(lo, key) >= 0) && (hi == nil || o.compare(hi, key) < 0)
+}
@@ -0,0 +1,157 @@
+package tree
+
+import (
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertSound(t *testing.T, tree *Tree) {
+	t.Helper()
+	problems, err := Verify(tree)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestVerifySound(t *testing.T) {
+	tree, err := Load(2, 1, mem.New(), countingRows(1, 1000), 0.7)
+	require.Nil(t, err)
+	assertSound(t, tree)
+
+	for i := 1000; i < 2000; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), 0}))
+	}
+	assertSound(t, tree)
+}
+
+func TestVerifyProblems(t *testing.T) {
+	half := buildBlock(0)
+	for i := 32; i < 64; i++ {
+		(*half)[i] = 0
+	}
+
+	for _, test := range []struct {
+		name     string
+		build    func(s *mem.Store) (domain.Word, int)
+		expected []Problem
+	}{
+		{
+			name: "Unordered",
+			build: func(s *mem.Store) (domain.Word, int) {
+				id, _ := s.AddBlock(&domain.Block{0, 0, 5, 1, 3, 2, 7, 3})
+				return id, 0
+			},
+			expected: []Problem{{Unordered, 64, 0, 2}},
+		},
+		{
+			name: "BadWidth",
+			build: func(s *mem.Store) (domain.Word, int) {
+				d1, _ := s.AddBlock(buildBlock(0))
+				d2, _ := s.AddBlock(&domain.Block{32, 1, 33, 1})
+				id, _ := s.AddBlock(&domain.Block{0, d1, 32, d2})
+				return id, 1
+			},
+			expected: []Problem{{BadWidth, 128, 0, -1}},
+		},
+		{
+			name: "BadSeparator",
+			build: func(s *mem.Store) (domain.Word, int) {
+				d1, _ := s.AddBlock(half)
+				d2, _ := s.AddBlock(buildBlock(10))
+				id, _ := s.AddBlock(&domain.Block{0, d1, 20, d2})
+				return id, 1
+			},
+			expected: []Problem{
+				{BadSeparator, 128, 0, 0},
+				{BadSeparator, 128, 0, 1},
+				{BadSeparator, 128, 0, 2},
+				{BadSeparator, 128, 0, 3},
+				{BadSeparator, 128, 0, 4},
+				{BadSeparator, 128, 0, 5},
+				{BadSeparator, 128, 0, 6},
+				{BadSeparator, 128, 0, 7},
+				{BadSeparator, 128, 0, 8},
+				{BadSeparator, 128, 0, 9},
+			},
+		},
+		{
+			name: "SharedBlock",
+			build: func(s *mem.Store) (domain.Word, int) {
+				d1, _ := s.AddBlock(half)
+				id, _ := s.AddBlock(&domain.Block{0, d1, 32, d1})
+				return id, 1
+			},
+			expected: []Problem{{SharedBlock, 64, 0, -1}},
+		},
+		{
+			name: "LeafAboveBottom",
+			build: func(s *mem.Store) (domain.Word, int) {
+				d1, _ := s.AddBlock(half)
+				i1, _ := s.AddBlock(&domain.Block{0, d1})
+				d2, _ := s.AddBlock(&domain.Block{32, 1000, 48, 2000})
+				id, _ := s.AddBlock(&domain.Block{0, i1, 32, d2})
+				return id, 2
+			},
+			expected: []Problem{
+				{BadWidth, 128, 1, -1},
+				{BadDepth, 192, 1, -1},
+			},
+		},
+		{
+			name: "InteriorAtBottom",
+			build: func(s *mem.Store) (domain.Word, int) {
+				d1, _ := s.AddBlock(half)
+				var left, right domain.Block
+				for i := 0; i < 16; i++ {
+					left[i*2], left[i*2+1] = domain.Word(32+i), 1
+					right[i*2], right[i*2+1] = domain.Word(48+i), 1
+				}
+				d3, _ := s.AddBlock(&left)
+				d4, _ := s.AddBlock(&right)
+				i2, _ := s.AddBlock(&domain.Block{32, d3, 48, d4})
+				id, _ := s.AddBlock(&domain.Block{0, d1, 32, i2})
+				return id, 1
+			},
+			expected: []Problem{{BadDepth, 256, 0, -1}},
+		},
+		{
+			name: "BadChild",
+			build: func(s *mem.Store) (domain.Word, int) {
+				d1, _ := s.AddBlock(half)
+				id, _ := s.AddBlock(&domain.Block{0, d1, 32, 5000})
+				return id, 1
+			},
+			expected: []Problem{{BadChild, 128, 1, 1}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := mem.New()
+			root, depth := test.build(store)
+			problems, err := Verify(New(2, 1, store, depth, root))
+			require.Nil(t, err)
+			assert.Equal(t, test.expected, problems)
+		})
+	}
+}
+
+func TestVerifyUnbalanced(t *testing.T) {
+	store := mem.New()
+	tree, err := Load(2, 1, store, countingRows(1, 3000), 0.7)
+	require.Nil(t, err)
+	require.Equal(t, 2, tree.Depth())
+
+	// the root's second child is replaced by the first leaf under it
+	var root, child domain.Block
+	require.Nil(t, store.ReadBlock(tree.Root(), &root))
+	require.Nil(t, store.ReadBlock(root[3], &child))
+	root[3] = child[1]
+	_, err = store.WriteBlock(tree.Root(), &root)
+	require.Nil(t, err)
+
+	problems, err := Verify(New(2, 1, store, 2, tree.Root()))
+	require.Nil(t, err)
+	assert.Equal(t, []Problem{{BadDepth, child[1], 1, -1}}, problems)
+}
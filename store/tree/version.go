@@ -0,0 +1,101 @@
+package tree
+
+import (
+	"sync/atomic"
+
+	"github.com/catlev/pkg/domain"
+)
+
+// Any number of goroutines may read a tree while one at a time writes to it. The writer works on
+// the root and depth held in the tree, and publishes them as a version once each mutation is
+// complete. Readers start from the latest version published.
+//
+// When blocks are overwritten in place, readers hold the latch shared for as long as they look at
+// blocks, and the writer holds it exclusively. In copy-on-write mode, a range pins the version it
+// starts on by marking it shared, after which the writer leaves every block of that version alone,
+// and so neither has to wait for the other.
+
+// A version is the state of a tree as of the end of some mutation.
+type version struct {
+	root  domain.Word
+	depth int
+	// shared is set once something may look at the blocks of the version outside the latch.
+	shared atomic.Bool
+}
+
+func (t *Tree) publish() {
+	t.current.Store(&version{
+		root:  t.root,
+		depth: t.depth,
+	})
+}
+
+// publishChanges publishes the state of the tree as the writer has it, and calls the hook set by
+// OnRoot if the root or depth differ from those last published.
+func (t *Tree) publishChanges() error {
+	prev := t.current.Load()
+	t.publish()
+	if t.onRoot == nil || prev.root == t.root && prev.depth == t.depth {
+		return nil
+	}
+	return t.onRoot(t.root, t.depth)
+}
+
+// working gives the state of the tree as the writer has it, ahead of what is published.
+func (t *Tree) working() *version {
+	return &version{
+		root:  t.root,
+		depth: t.depth,
+	}
+}
+
+// beginWrite excludes other writers, and readers too for as long as blocks they can reach may be
+// overwritten.
+func (t *Tree) beginWrite() {
+	t.writer.Lock()
+	t.latch.Lock()
+	t.latched = true
+
+	if t.cow && t.current.Load().shared.Load() {
+		// everything reachable from the current version is off limits, so readers can carry on
+		t.fresh = map[domain.Word]bool{}
+		t.latch.Unlock()
+		t.latched = false
+	}
+}
+
+// endWrite publishes whatever the writer changed and lets others in. If the root has moved, the
+// error from the hook set by OnRoot, if any, becomes the error of the mutation.
+func (t *Tree) endWrite(err *error) {
+	if t.changed {
+		hookErr := t.publishChanges()
+		if *err == nil {
+			*err = hookErr
+		}
+		t.changed = false
+	}
+	if t.latched {
+		t.latch.Unlock()
+		t.latched = false
+	}
+	t.writer.Unlock()
+}
+
+// beginRead gives the latest version of the tree, which may be read until endRead.
+func (t *Tree) beginRead() *version {
+	t.latch.RLock()
+	return t.current.Load()
+}
+
+func (t *Tree) endRead() {
+	t.latch.RUnlock()
+}
+
+// pin gives the latest version of the tree, which may be read for as long as it is needed in
+// copy-on-write mode.
+func (t *Tree) pin() *version {
+	v := t.beginRead()
+	v.shared.Store(true)
+	t.endRead()
+	return v
+}
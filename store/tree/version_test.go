@@ -0,0 +1,170 @@
+package tree
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/catlev/pkg/domain"
+	"github.com/catlev/pkg/store/block/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentReaders(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"InPlace", nil},
+		{"CopyOnWrite", []Option{CopyOnWrite()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := mem.New()
+			start, _ := store.AddBlock(&domain.Block{})
+			tree := New(2, 1, store, 0, start, test.opts...)
+
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						k := domain.Word(rng.Intn(2000) + 1)
+						if rng.Intn(50) == 0 {
+							assertScan(t, tree, k)
+							continue
+						}
+						row, err := tree.Get([]domain.Word{k})
+						if errors.Is(err, ErrNotFound) {
+							continue
+						}
+						if assert.Nil(t, err) {
+							assert.Equal(t, k*2, row[1])
+						}
+					}
+				}(int64(i))
+			}
+
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 5000; i++ {
+				k := domain.Word(rng.Intn(2000) + 1)
+				if rng.Intn(3) == 0 {
+					tree.Delete([]domain.Word{k})
+				} else {
+					require.Nil(t, tree.Put([]domain.Word{k, k * 2}))
+				}
+			}
+			close(done)
+			wg.Wait()
+
+			assertSound(t, tree)
+		})
+	}
+}
+
+// assertScan checks a stretch of the tree from the given key, which may be cut short by a write.
+func assertScan(t *testing.T, tree *Tree, from domain.Word) {
+	r := tree.GetRange(Inclusive(key(from)), Inclusive(key(from+100)))
+	last := domain.Word(0)
+	for r.Next() {
+		row := r.This()
+		assert.Less(t, last, row[0])
+		assert.Equal(t, row[0]*2, row[1])
+		last = row[0]
+	}
+	if r.Err() != nil {
+		assert.ErrorIs(t, r.Err(), ErrChanged)
+		assert.False(t, tree.cow)
+	}
+}
+
+func TestRangeCopyOnWrite(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start, CopyOnWrite())
+	for i := 1; i <= 500; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), 1}))
+	}
+
+	r := tree.GetRange(Inclusive(key(1)), Bound{})
+	require.True(t, r.Next())
+
+	// the range keeps to the tree as it was when it started
+	for i := 1; i <= 1000; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), 2}))
+	}
+	for i := 1; i <= 500; i += 2 {
+		require.Nil(t, tree.Delete([]domain.Word{domain.Word(i)}))
+	}
+
+	count := 1
+	for r.Next() {
+		count++
+		assert.Equal(t, []domain.Word{domain.Word(count), 1}, r.This())
+	}
+	assert.Nil(t, r.Err())
+	assert.Equal(t, 500, count)
+
+	assertSound(t, tree)
+	assert.Equal(t, domain.Word(2), getRow(t, tree, key(1000))[1])
+}
+
+func TestRangeChanged(t *testing.T) {
+	store := mem.New()
+	start, _ := store.AddBlock(&domain.Block{})
+	tree := New(2, 1, store, 0, start)
+	for i := 1; i <= 50; i++ {
+		require.Nil(t, tree.Put([]domain.Word{domain.Word(i), 1}))
+	}
+
+	r := tree.GetRange(Inclusive(key(1)), Bound{})
+	require.True(t, r.Next())
+
+	// a failed write leaves the tree as it was
+	assert.ErrorIs(t, tree.Delete(key(100)), ErrNotFound)
+	require.True(t, r.Next())
+
+	require.Nil(t, tree.Put([]domain.Word{100, 1}))
+	assert.False(t, r.Next())
+	assert.ErrorIs(t, r.Err(), ErrChanged)
+}
+
+func TestOnRoot(t *testing.T) {
+	var roots []domain.Word
+	fail := errors.New("fail")
+	var hookErr error
+
+	var tree *Tree
+	tree = newTestTree(2, 1, OnRoot(func(root domain.Word, depth int) error {
+		assert.Equal(t, tree.Root(), root)
+		assert.Equal(t, tree.Depth(), depth)
+		roots = append(roots, root)
+		return hookErr
+	}))
+
+	for k := domain.Word(1); k <= 100; k++ {
+		require.Nil(t, tree.Put([]domain.Word{k, k}))
+	}
+	// in place, the root only moves when the tree grows
+	assert.Equal(t, tree.Depth(), len(roots))
+
+	hookErr = fail
+	for k := domain.Word(1); k <= 100; k++ {
+		err := tree.Delete([]domain.Word{k})
+		if tree.Depth() == 0 {
+			assert.ErrorIs(t, err, fail)
+			break
+		}
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 0, tree.Depth())
+}
@@ -129,6 +129,20 @@ func (p *Reader) IntField() int {
 	return res
 }
 
+// UintField reads a field and interprets it as an unsigned integer. If the current section is not
+// a field containing an unsigned integer then an error is signalled.
+func (p *Reader) UintField() uint64 {
+	attr := p.parseAttr()
+	if attr == "" {
+		return 0
+	}
+	res, err := strconv.ParseUint(attr[1:len(attr)-1], 10, 64)
+	if err != nil {
+		p.setErr(err)
+	}
+	return res
+}
+
 // BoolField reads a field and interprets it as a boolean. If the current
 // section is not a field containing a boolean then an error is signalled.
 func (p *Reader) BoolField() bool {
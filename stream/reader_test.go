@@ -304,3 +304,13 @@ func TestFail_Misc(t *testing.T) {
 		t.Error("stick error failed")
 	}
 }
+
+func TestUintField(t *testing.T) {
+	r := NewReader(strings.NewReader(`big: "18446744073709551615" neg: "-1"`))
+	if !r.Next() || r.UintField() != 1<<64-1 || r.Err() != nil {
+		t.Error("failed to read the largest value")
+	}
+	if !r.Next() || r.UintField() != 0 || r.Err() == nil {
+		t.Error("read a negative value")
+	}
+}
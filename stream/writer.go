@@ -37,6 +37,10 @@ func (w *Writer) IntField(name string, value int) {
 	w.StringField(name, strconv.Itoa(value))
 }
 
+func (w *Writer) UintField(name string, value uint64) {
+	w.StringField(name, strconv.FormatUint(value, 10))
+}
+
 func (w *Writer) BoolField(name string, value bool) {
 	v := "false"
 	if value {
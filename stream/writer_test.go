@@ -19,3 +19,13 @@ func TestWriteField(t *testing.T) {
 		t.Errorf("got %q, expecting %q", buf.String(), expected)
 	}
 }
+
+func TestWriteUintField(t *testing.T) {
+	var buf strings.Builder
+	w := NewWriter(&buf)
+	w.UintField("uint", 1<<64-1)
+	expected := `uint:"18446744073709551615"`
+	if buf.String() != expected {
+		t.Errorf("got %q, expecting %q", buf.String(), expected)
+	}
+}